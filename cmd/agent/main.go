@@ -20,9 +20,11 @@ func main() {
 	log := logger.Sugar()
 
 	cfg := agent.Config{}
-	flag.StringVar(&cfg.ServerAddress, "a", "localhost:8080", "HTTP server address")
+	flag.StringVar(&cfg.ServerAddress, "a", "localhost:8080", "HTTP server address, or comma-separated addresses to shard metrics across (http transport only)")
 	flag.IntVar(&cfg.PollInterval, "p", 2, "Poll interval (seconds)")
 	flag.IntVar(&cfg.ReportInterval, "r", 10, "Report interval (seconds)")
+	flag.StringVar(&cfg.Transport, "t", "http", "Transport to send metrics with (http or grpc)")
+	flag.StringVar(&cfg.GRPCAddress, "g", "localhost:3200", "gRPC server address")
 	flag.Parse()
 
 	cfg.ApplyEnv()
@@ -4,12 +4,14 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/kosta324/metrics.git/internal/agent"
+	"github.com/kosta324/metrics.git/internal/cluster"
 	"github.com/kosta324/metrics.git/internal/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -75,3 +77,55 @@ func TestSendMetricsBatch(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestSendMetricsSharded(t *testing.T) {
+	received := make(map[string][]string)
+	var servers []string
+	for i := 0; i < 2; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gr, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			var batch []models.Metrics
+			require.NoError(t, json.NewDecoder(gr).Decode(&batch))
+			for _, m := range batch {
+				received[r.Host] = append(received[r.Host], m.ID)
+			}
+		}))
+		defer ts.Close()
+		servers = append(servers, ts.Listener.Addr().String())
+	}
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err, "failed to create logger")
+	defer logger.Sync()
+
+	ring := cluster.NewRing(servers, cluster.DefaultVirtualNodes)
+	var batch []models.Metrics
+	for i := 0; i < 50; i++ {
+		v := float64(i)
+		batch = append(batch, models.Metrics{ID: fmt.Sprintf("Metric%d", i), MType: "gauge", Value: &v})
+	}
+	require.NoError(t, agent.SendMetricsSharded(context.Background(), ring, batch, logger.Sugar()))
+
+	total := 0
+	for server, names := range received {
+		for _, name := range names {
+			assert.Equal(t, ring.Owner(name), server)
+		}
+		total += len(names)
+	}
+	assert.Equal(t, 50, total)
+	assert.Len(t, received, 2)
+}
+
+func TestRunRejectsShardedGRPC(t *testing.T) {
+	cfg := agent.Config{
+		ServerAddress:  "localhost:8080,localhost:8081",
+		PollInterval:   1,
+		ReportInterval: 1,
+		Transport:      "grpc",
+		GRPCAddress:    "localhost:3200",
+	}
+	err := agent.Run(context.Background(), cfg, zap.NewNop().Sugar())
+	assert.ErrorContains(t, err, "http transport")
+}
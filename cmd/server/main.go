@@ -3,20 +3,33 @@ package main
 import (
 	"context"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/kosta324/metrics.git/internal/audit"
+	"github.com/kosta324/metrics.git/internal/broadcast"
+	"github.com/kosta324/metrics.git/internal/cluster"
+	"github.com/kosta324/metrics.git/internal/db"
+	"github.com/kosta324/metrics.git/internal/federation"
+	"github.com/kosta324/metrics.git/internal/grpcserver"
 	"github.com/kosta324/metrics.git/internal/handlers"
+	"github.com/kosta324/metrics.git/internal/history"
+	"github.com/kosta324/metrics.git/internal/ingest"
 	"github.com/kosta324/metrics.git/internal/logger"
+	pb "github.com/kosta324/metrics.git/internal/proto"
+	"github.com/kosta324/metrics.git/internal/replication"
 	"github.com/kosta324/metrics.git/internal/storage"
 	"github.com/kosta324/metrics.git/internal/zipper"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -24,35 +37,152 @@ var (
 	storeInterval = flag.Int("i", 300, "Store interval in seconds (0 = sync write)")
 	filePath      = flag.String("f", "/tmp/metrics-db.json", "File storage path")
 	restore       = flag.Bool("r", true, "Restore metrics from file on startup")
-	dbDSN         = flag.String("d", "", "PostgreSQL DSN")
+	dbDSN         = flag.String("d", "", "PostgreSQL DSN, sqlite:// DSN or SQLite file path")
+	replicaDSN    = flag.String("replica", "", "PostgreSQL read replica DSN (empty = read from primary)")
+	replicaMaxLag = flag.Int("replica-max-lag", 5, "Maximum replica lag in seconds before reads fall back to primary")
+	grpcAddr      = flag.String("g", "", "gRPC server address (empty = disabled)")
+	role          = flag.String("role", "", "Replication role without a DB: primary or replica (empty = standalone)")
+	replicas      = flag.String("replicas", "", "Comma-separated base URLs of the replicas' -replication-addr a primary pushes updates to")
+	replAddr      = flag.String("replication-addr", "", "Address to serve the unauthenticated replication endpoints on; required with -role")
+	clusterNodes  = flag.String("cluster", "", "Comma-separated addresses of all sharded servers, as given to agents")
+	clusterSelf   = flag.String("self", "", "This server's address in the -cluster list (default: -a)")
+	federate      = flag.String("federate", "", "Comma-separated downstream servers to pull metrics from, as name=host:port")
+	federateEvery = flag.Int("federate-interval", 10, "Federation pull interval in seconds")
+	historySize   = flag.Int("history", 120, "Number of samples kept per metric for dashboard charts (0 = disabled)")
+	historyEvery  = flag.Int("history-interval", 5, "Seconds between history samples")
+	auditFile     = flag.String("audit-file", "", "File to append audit events of accepted updates to")
+	auditURL      = flag.String("audit-url", "", "URL to post audit events of accepted updates to")
+	trustedProxy  = flag.String("trusted-proxies", "", "Comma-separated IPs or CIDRs of reverse proxies whose X-Real-IP is trusted for audit")
+	cacheEnabled  = flag.Bool("cache", false, "Serve reads from an in-memory cache in front of the DB, kept coherent across instances via LISTEN/NOTIFY")
+	cacheFlush    = flag.Int("cache-flush", 0, "Cache flush interval in seconds (0 = write-through)")
+	queueSize     = flag.Int("queue", 0, "Ingestion queue size in requests (0 = write synchronously)")
+	queueFlush    = flag.Int("queue-flush-ms", 100, "Ingestion queue flush interval in milliseconds")
+	queueBatch    = flag.Int("queue-batch", 1000, "Number of queued updates that triggers a flush")
+
+	dbMaxOpen        = flag.Int("db-max-open", dbDefaults.MaxOpenConns, "Maximum number of open DB connections")
+	dbMaxIdle        = flag.Int("db-max-idle", dbDefaults.MaxIdleConns, "Maximum number of idle DB connections")
+	dbConnLifetime   = flag.Int("db-conn-lifetime", int(dbDefaults.ConnMaxLifetime/time.Second), "Maximum DB connection lifetime in seconds (0 = unlimited)")
+	dbStmtTimeout    = flag.Int("db-statement-timeout-ms", int(dbDefaults.StatementTimeout/time.Millisecond), "DB statement timeout in milliseconds (0 = server default)")
+	dbConnectTimeout = flag.Int("db-connect-timeout", int(dbDefaults.ConnectTimeout/time.Second), "DB connect timeout in seconds")
+	dbStartupTimeout = flag.Int("db-startup-timeout", int(dbDefaults.StartupTimeout/time.Second), "How long to wait for the DB on startup in seconds")
+	dbStatsInterval  = flag.Int("db-stats-interval", 10, "DB pool stats reporting interval in seconds (0 = disabled)")
+	instance         = flag.String("instance", "", "Name prefixed to the DB pool stats this server reports (default: hostname and port of -a)")
 )
 
+var dbDefaults = db.DefaultConfig("")
+
 var log zap.SugaredLogger
 
 func parseEnvOverrides() {
 	flag.Parse()
-	if len(flag.Args()) > 0 {
+	if len(flag.Args()) > 0 && flag.Arg(0) != "migrate" {
 		log.Fatalf("unknown arguments: %v", flag.Args())
 	}
 	if v, ok := os.LookupEnv("ADDRESS"); ok {
 		*addr = v
 	}
-	if v, ok := os.LookupEnv("STORE_INTERVAL"); ok {
-		if i, err := strconv.Atoi(v); err == nil {
-			*storeInterval = i
-		}
-	}
+	envInt("STORE_INTERVAL", storeInterval)
 	if v, ok := os.LookupEnv("FILE_STORAGE_PATH"); ok {
 		*filePath = v
 	}
-	if v, ok := os.LookupEnv("RESTORE"); ok {
+	envBool("RESTORE", restore)
+	if envDSN, ok := os.LookupEnv("DATABASE_DSN"); ok {
+		*dbDSN = envDSN
+	}
+	if v, ok := os.LookupEnv("DATABASE_REPLICA_DSN"); ok {
+		*replicaDSN = v
+	}
+	envInt("DATABASE_REPLICA_MAX_LAG", replicaMaxLag)
+	if v, ok := os.LookupEnv("GRPC_ADDRESS"); ok {
+		*grpcAddr = v
+	}
+	if v, ok := os.LookupEnv("REPLICATION_ROLE"); ok {
+		*role = v
+	}
+	if v, ok := os.LookupEnv("REPLICAS"); ok {
+		*replicas = v
+	}
+	if v, ok := os.LookupEnv("REPLICATION_ADDRESS"); ok {
+		*replAddr = v
+	}
+	if v, ok := os.LookupEnv("CLUSTER_NODES"); ok {
+		*clusterNodes = v
+	}
+	if v, ok := os.LookupEnv("CLUSTER_SELF"); ok {
+		*clusterSelf = v
+	}
+	if v, ok := os.LookupEnv("FEDERATE_SOURCES"); ok {
+		*federate = v
+	}
+	envInt("FEDERATE_INTERVAL", federateEvery)
+	if v, ok := os.LookupEnv("AUDIT_FILE"); ok {
+		*auditFile = v
+	}
+	if v, ok := os.LookupEnv("AUDIT_URL"); ok {
+		*auditURL = v
+	}
+	if v, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		*trustedProxy = v
+	}
+	envInt("HISTORY_SIZE", historySize)
+	envInt("HISTORY_INTERVAL", historyEvery)
+	envBool("CACHE", cacheEnabled)
+	envInt("CACHE_FLUSH_INTERVAL", cacheFlush)
+	envInt("INGEST_QUEUE_SIZE", queueSize)
+	envInt("INGEST_FLUSH_INTERVAL_MS", queueFlush)
+	envInt("INGEST_FLUSH_BATCH", queueBatch)
+	envInt("DB_MAX_OPEN_CONNS", dbMaxOpen)
+	envInt("DB_MAX_IDLE_CONNS", dbMaxIdle)
+	envInt("DB_CONN_MAX_LIFETIME", dbConnLifetime)
+	envInt("DB_STATEMENT_TIMEOUT_MS", dbStmtTimeout)
+	envInt("DB_CONNECT_TIMEOUT", dbConnectTimeout)
+	envInt("DB_STARTUP_TIMEOUT", dbStartupTimeout)
+	envInt("DB_STATS_INTERVAL", dbStatsInterval)
+	if v, ok := os.LookupEnv("INSTANCE_NAME"); ok {
+		*instance = v
+	}
+}
+
+func envInt(key string, dst *int) {
+	if v, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			*dst = i
+		}
+	}
+}
+
+func envBool(key string, dst *bool) {
+	if v, ok := os.LookupEnv(key); ok {
 		if b, err := strconv.ParseBool(v); err == nil {
-			*restore = b
+			*dst = b
 		}
 	}
-	if envDSN, ok := os.LookupEnv("DATABASE_DSN"); ok {
-		*dbDSN = envDSN
+}
+
+func dbConfig() db.Config {
+	return db.Config{
+		DSN:              *dbDSN,
+		MaxOpenConns:     *dbMaxOpen,
+		MaxIdleConns:     *dbMaxIdle,
+		ConnMaxLifetime:  time.Duration(*dbConnLifetime) * time.Second,
+		StatementTimeout: time.Duration(*dbStmtTimeout) * time.Millisecond,
+		ConnectTimeout:   time.Duration(*dbConnectTimeout) * time.Second,
+		StartupTimeout:   time.Duration(*dbStartupTimeout) * time.Second,
+	}
+}
+
+func instanceName() string {
+	if *instance != "" {
+		return *instance
 	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	if _, port, err := net.SplitHostPort(*addr); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return host
 }
 
 func main() {
@@ -66,18 +196,46 @@ func main() {
 
 	parseEnvOverrides()
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			log.Fatalf("migrate failed: %v", err)
+		}
+		return
+	}
+
 	var repo storage.Repository
-	var sqlDB *storage.SQLRepo
-	if *dbDSN != "" {
-		sqlDB, err = storage.NewSQLStorage(*dbDSN)
+	var memRepo *storage.MemStorage
+	var sqlRepo *storage.SQLRepo
+	if path, ok := storage.SQLitePath(*dbDSN); ok {
+		sqliteDB, err := storage.NewSQLiteStorage(path)
+		if err != nil {
+			log.Fatalf("failed to open SQLite DB: %v", err)
+		}
+		defer sqliteDB.Close()
+		repo = sqliteDB
+	} else if *dbDSN != "" {
+		sqlRepo, err = storage.NewSQLStorage(context.Background(), dbConfig())
 		if err != nil {
 			log.Fatalf("failed to connect to DB: %v", err)
 		}
-		repo = sqlDB
+		defer sqlRepo.Close()
+		if *replicaDSN != "" {
+			cfg := dbConfig()
+			cfg.DSN = *replicaDSN
+			replicaDB, err := db.Open(context.Background(), cfg)
+			if err != nil {
+				log.Warnf("failed to connect to read replica, reading from primary: %v", err)
+			} else {
+				sqlRepo.SetReplica(replicaDB, time.Duration(*replicaMaxLag)*time.Second)
+			}
+		}
+		repo = sqlRepo
 	} else if *filePath != "" {
-		memRepo := storage.NewMemStorage()
+		memRepo = storage.NewMemStorage()
 		memRepo.SetFilePath(*filePath)
-		if *restore {
+		// A replica gets its state from the primary; restoring a file as well
+		// would apply updates on top of an unknown base.
+		if *restore && *role != string(replication.RoleReplica) {
 			if err := memRepo.LoadFromFile(); err != nil {
 				log.Warnf("failed to load metrics: %v", err)
 			}
@@ -95,21 +253,170 @@ func main() {
 			}()
 		}
 	} else {
-		repo = storage.NewMemStorage()
+		memRepo = storage.NewMemStorage()
+		repo = memRepo
 	}
 
-	r := chi.NewRouter()
+	var node *replication.Node
+	if *role != "" {
+		if memRepo == nil {
+			log.Fatalf("replication requires in-memory storage, not a DB")
+		}
+		r := replication.Role(*role)
+		if r != replication.RolePrimary && r != replication.RoleReplica {
+			log.Fatalf("unknown replication role: %s", *role)
+		}
+		if *replAddr == "" {
+			log.Fatalf("replication requires -replication-addr: its endpoints are unauthenticated and are not served on the public address")
+		}
+		var peers []string
+		if *replicas != "" {
+			peers = strings.Split(*replicas, ",")
+		}
+		node = replication.NewNode(memRepo, replication.Config{
+			Role:     r,
+			Replicas: peers,
+			OnError: func(replica string, err error) {
+				log.Warnf("replication to %s failed: %v", replica, err)
+			},
+		})
+		repo = node
+	}
 
-	r.Use(zipper.GzipMiddleware)
-	r.Use(logger.WithLogging(&log))
+	var cachedRepo *storage.CachedRepo
+	if *cacheEnabled && *dbDSN != "" {
+		cachedRepo, err = storage.NewCachedRepo(context.Background(), repo, storage.CacheConfig{
+			FlushInterval: time.Duration(*cacheFlush) * time.Second,
+			OnFlushError: func(err error) {
+				log.Errorf("cache flush failed: %v", err)
+			},
+		})
+		if err != nil {
+			log.Fatalf("failed to initialize cache: %v", err)
+		}
+		repo = cachedRepo
+	}
+
+	var queue *ingest.Queue
+	if *queueSize > 0 {
+		queue, err = ingest.NewQueue(repo, ingest.Config{
+			QueueSize:     *queueSize,
+			FlushInterval: time.Duration(*queueFlush) * time.Millisecond,
+			FlushBatch:    *queueBatch,
+			OnFlushError: func(err error) {
+				log.Errorf("ingest queue flush failed: %v", err)
+			},
+		})
+		if err != nil {
+			log.Fatalf("invalid ingest queue settings: %v", err)
+		}
+		repo = queue
+	}
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if sqlRepo != nil && cachedRepo != nil {
+		go storage.WatchChanges(bgCtx, dbConfig(), sqlRepo, cachedRepo, func(err error) {
+			log.Warnf("cache coherence: %v", err)
+		})
+	}
+	if *federate != "" {
+		sources, err := federation.ParseSources(*federate)
+		if err != nil {
+			log.Fatalf("invalid federation sources: %v", err)
+		}
+		puller := federation.NewPuller(repo, federation.Config{
+			Sources:  sources,
+			Interval: time.Duration(*federateEvery) * time.Second,
+			OnError: func(source string, err error) {
+				log.Warnf("failed to pull metrics from %s: %v", source, err)
+			},
+		})
+		go puller.Run(bgCtx)
+	}
+	if sqlRepo != nil && *dbStatsInterval > 0 {
+		go db.ReportStats(bgCtx, sqlRepo.DB(), repo, instanceName(), time.Duration(*dbStatsInterval)*time.Second, func(err error) {
+			log.Warnf("failed to report DB pool stats: %v", err)
+		})
+	}
 
 	handler := handlers.NewHandler(repo, &log)
-	handler.RegisterRoutes(r)
+	if *historySize > 0 && *historyEvery > 0 {
+		hist := history.NewStore(*historySize)
+		go hist.Run(bgCtx, repo, time.Duration(*historyEvery)*time.Second, func(err error) {
+			log.Warnf("failed to sample metrics history: %v", err)
+		})
+		handler.SetHistory(hist)
+	}
+
+	broadcaster := broadcast.New(256)
+	handler.SetBroadcaster(broadcaster)
+
+	var auditor *audit.Publisher
+	if *auditFile != "" || *auditURL != "" {
+		auditor = audit.NewPublisher(1000, func(err error) {
+			log.Warnf("audit: %v", err)
+		})
+		if *auditFile != "" {
+			sink, err := audit.NewFileSink(*auditFile)
+			if err != nil {
+				log.Fatalf("failed to set up audit: %v", err)
+			}
+			defer sink.Close()
+			auditor.Subscribe(sink)
+		}
+		if *auditURL != "" {
+			auditor.Subscribe(audit.NewHTTPSink(*auditURL))
+		}
+		handler.SetAudit(auditor)
+		proxies, err := handlers.ParseTrustedProxies(*trustedProxy)
+		if err != nil {
+			log.Fatalf("invalid trusted proxies: %v", err)
+		}
+		handler.SetTrustedProxies(proxies)
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			var reported int64
+			for {
+				select {
+				case <-bgCtx.Done():
+					return
+				case <-ticker.C:
+					if n := auditor.Dropped(); n > reported {
+						log.Warnf("%d audit events were dropped in the last minute", n-reported)
+						reported = n
+					}
+				}
+			}
+		}()
+	}
+	if nodes := cluster.ParseNodes(*clusterNodes); len(nodes) > 0 {
+		self := *clusterSelf
+		if self == "" {
+			self = *addr
+		}
+		if !slices.Contains(nodes, self) {
+			log.Fatalf("cluster node list %v does not contain this server (%s)", nodes, self)
+		}
+		handler.SetCluster(cluster.New(self, nodes))
+	}
+	r := newRouter(handler)
+	var replServer *http.Server
+	if node != nil {
+		replServer = &http.Server{
+			Addr:    *replAddr,
+			Handler: newReplicationRouter(node),
+		}
+	}
 
 	server := &http.Server{
 		Addr:    *addr,
 		Handler: r,
 	}
+	// Shutdown does not cancel request contexts; closing the broadcaster ends
+	// streams and long polls so that they do not hold it up.
+	server.RegisterOnShutdown(broadcaster.Close)
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
@@ -121,16 +428,83 @@ func main() {
 		}
 	}()
 
+	if replServer != nil {
+		go func() {
+			log.Info("Replication server running", zap.String("addr", *replAddr))
+			if err := replServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Replication server failed: %v", zap.Error(err))
+			}
+		}()
+	}
+
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on gRPC address: %v", err)
+		}
+		grpcServer = grpc.NewServer()
+		metricsServer := grpcserver.NewMetricsServer(repo, &log)
+		metricsServer.SetNotifier(handler.NotifyUpdate)
+		pb.RegisterMetricsServer(grpcServer, metricsServer)
+
+		go func() {
+			log.Info("gRPC server running", zap.String("addr", *grpcAddr))
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("gRPC server failed: %v", zap.Error(err))
+			}
+		}()
+	}
+
 	<-stop
 	log.Info("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	stopBackground()
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// Data still has to be flushed below, so this is not fatal.
+		log.Errorf("HTTP server shutdown failed: %v", err)
+	}
+	if replServer != nil {
+		if err := replServer.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("replication server shutdown failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown failed: %v", zap.Error(err))
+
+	if queue != nil {
+		if err := queue.Close(ctx); err != nil {
+			log.Errorf("failed to flush ingest queue on shutdown: %v", err)
+		}
+	}
+
+	if cachedRepo != nil {
+		if err := cachedRepo.Close(ctx); err != nil {
+			log.Errorf("failed to flush cache on shutdown: %v", err)
+		}
+	}
+
+	if node != nil {
+		node.Close()
+	}
+
+	if auditor != nil {
+		if err := auditor.Close(ctx); err != nil {
+			log.Errorf("failed to flush audit events on shutdown: %v", err)
+		}
+		if n := auditor.Dropped(); n > 0 {
+			log.Warnf("%d audit events were dropped", n)
+		}
 	}
 
-	if memRepo, ok := repo.(*storage.MemStorage); ok && *filePath != "" {
+	if memRepo != nil && *filePath != "" {
 		if err := memRepo.SaveToFile(); err != nil {
 			log.Errorf("failed to save metrics on shutdown: %v", err)
 		}
@@ -138,3 +512,20 @@ func main() {
 
 	log.Info("Server stopped gracefully")
 }
+
+// newRouter builds the public API router. Replication endpoints are never
+// mounted on it because they are unauthenticated.
+func newRouter(handler *handlers.Handler) chi.Router {
+	r := chi.NewRouter()
+	r.Use(zipper.GzipMiddleware)
+	r.Use(logger.WithLogging(&log))
+	handler.RegisterRoutes(r)
+	return r
+}
+
+func newReplicationRouter(node *replication.Node) chi.Router {
+	r := chi.NewRouter()
+	r.Use(logger.WithLogging(&log))
+	node.RegisterRoutes(r)
+	return r
+}
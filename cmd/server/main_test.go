@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kosta324/metrics.git/internal/handlers"
+	"github.com/kosta324/metrics.git/internal/replication"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPublicRouterHidesReplication(t *testing.T) {
+	log = *zap.NewNop().Sugar()
+	mem := storage.NewMemStorage()
+	node := replication.NewNode(mem, replication.Config{Role: replication.RoleReplica})
+	defer node.Close()
+	public := newRouter(handlers.NewHandler(node, &log))
+	repl := newReplicationRouter(node)
+
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/replication/status", ""},
+		{http.MethodPost, "/replication/apply", `{"entries":[]}`},
+		{http.MethodPost, "/replication/snapshot", `{"seq":1,"metrics":[]}`},
+		{http.MethodPost, "/replication/promote", ""},
+	}
+	for _, tt := range requests {
+		w := httptest.NewRecorder()
+		public.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		assert.Equal(t, http.StatusNotFound, w.Code, "%s %s on the public router", tt.method, tt.path)
+	}
+	assert.Equal(t, replication.RoleReplica, node.Status().Role)
+
+	w := httptest.NewRecorder()
+	repl.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/replication/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestInstanceName(t *testing.T) {
+	oldInstance, oldAddr := *instance, *addr
+	defer func() { *instance, *addr = oldInstance, oldAddr }()
+	host, err := os.Hostname()
+	require.NoError(t, err)
+
+	*instance, *addr = "", "0.0.0.0:8081"
+	assert.Equal(t, host+":8081", instanceName())
+	*instance = "web-1"
+	assert.Equal(t, "web-1", instanceName())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/db"
+	"github.com/kosta324/metrics.git/internal/migrate"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+func runMigrate(args []string) error {
+	if *dbDSN == "" {
+		return fmt.Errorf("database DSN is required (-d or DATABASE_DSN)")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status|up|down [steps]")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var sqlDB *sql.DB
+	var err error
+	if path, ok := storage.SQLitePath(*dbDSN); ok {
+		sqlDB, err = storage.OpenSQLite(path)
+	} else {
+		sqlDB, err = db.Open(ctx, dbConfig())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open DB: %w", err)
+	}
+	defer sqlDB.Close()
+
+	var migrator *migrate.Migrator
+	if _, ok := storage.SQLitePath(*dbDSN); ok {
+		migrator, err = storage.NewSQLiteMigrator(sqlDB)
+	} else {
+		migrator, err = storage.NewPostgresMigrator(sqlDB)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if errors.Is(err, migrate.ErrNotInitialized) {
+			log.Info("database is not initialized, no migrations have been applied")
+		} else if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, s := range statuses {
+			state, appliedAt := "pending", ""
+			if s.Applied {
+				state, appliedAt = "applied", s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+		}
+		return tw.Flush()
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			log.Infof("applied migration %d_%s", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Info("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			log.Infof("reverted migration %d_%s", m.Version, m.Name)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+}
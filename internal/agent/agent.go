@@ -5,9 +5,14 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/kosta324/metrics.git/internal/cluster"
 	"github.com/kosta324/metrics.git/internal/models"
+	pb "github.com/kosta324/metrics.git/internal/proto"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"math/rand"
 	"net/http"
 	"os"
@@ -20,6 +25,8 @@ type Config struct {
 	ServerAddress  string
 	PollInterval   int
 	ReportInterval int
+	Transport      string
+	GRPCAddress    string
 }
 
 var pollCount int64
@@ -38,9 +45,44 @@ func (c *Config) ApplyEnv() {
 			c.ReportInterval = i
 		}
 	}
+	if v, ok := os.LookupEnv("TRANSPORT"); ok {
+		c.Transport = v
+	}
+	if v, ok := os.LookupEnv("GRPC_ADDRESS"); ok {
+		c.GRPCAddress = v
+	}
 }
 
 func Run(ctx context.Context, cfg Config, log *zap.SugaredLogger) error {
+	send := func(ctx context.Context, batch []models.Metrics) error {
+		return SendMetricsBatch(ctx, cfg.ServerAddress, batch, log)
+	}
+	servers := cluster.ParseNodes(cfg.ServerAddress)
+	if len(servers) > 1 {
+		ring := cluster.NewRing(servers, cluster.DefaultVirtualNodes)
+		send = func(ctx context.Context, batch []models.Metrics) error {
+			return SendMetricsSharded(ctx, ring, batch, log)
+		}
+	}
+	switch cfg.Transport {
+	case "", "http":
+	case "grpc":
+		if len(servers) > 1 {
+			return fmt.Errorf("sharding across %d servers is only supported with the http transport", len(servers))
+		}
+		conn, err := grpc.NewClient(cfg.GRPCAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return fmt.Errorf("failed to create gRPC client: %w", err)
+		}
+		defer conn.Close()
+		client := pb.NewMetricsClient(conn)
+		send = func(ctx context.Context, batch []models.Metrics) error {
+			return SendMetricsGRPC(ctx, client, batch)
+		}
+	default:
+		return fmt.Errorf("unknown transport: %s", cfg.Transport)
+	}
+
 	pollTicker := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
 	reportTicker := time.NewTicker(time.Duration(cfg.ReportInterval) * time.Second)
 	defer pollTicker.Stop()
@@ -110,7 +152,7 @@ func Run(ctx context.Context, cfg Config, log *zap.SugaredLogger) error {
 				MType: "counter",
 				Delta: &pollCount,
 			})
-			if err := SendMetricsBatch(ctx, cfg.ServerAddress, batch, log); err != nil {
+			if err := send(ctx, batch); err != nil {
 				log.Errorf("failed to send metrics batch: %v", err)
 			}
 		}
@@ -157,3 +199,15 @@ func SendMetricsBatch(ctx context.Context, server string, metrics []models.Metri
 
 	return nil
 }
+
+// SendMetricsSharded sends every metric to the server owning its name on the
+// ring. A failing server does not prevent delivery to the others.
+func SendMetricsSharded(ctx context.Context, ring *cluster.Ring, metrics []models.Metrics, log *zap.SugaredLogger) error {
+	var errs []error
+	for server, part := range ring.Split(metrics) {
+		if err := SendMetricsBatch(ctx, server, part, log); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+		}
+	}
+	return errors.Join(errs...)
+}
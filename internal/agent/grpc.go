@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	pb "github.com/kosta324/metrics.git/internal/proto"
+)
+
+func SendMetricsGRPC(ctx context.Context, client pb.MetricsClient, metrics []models.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	req := &pb.UpdateMetricsRequest{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		pm := &pb.Metric{Id: m.ID}
+		switch m.MType {
+		case "gauge":
+			if m.Value == nil {
+				return fmt.Errorf("missing gauge value for metric %s", m.ID)
+			}
+			pm.Type = pb.Metric_GAUGE
+			pm.Value = *m.Value
+		case "counter":
+			if m.Delta == nil {
+				return fmt.Errorf("missing counter delta for metric %s", m.ID)
+			}
+			pm.Type = pb.Metric_COUNTER
+			pm.Delta = *m.Delta
+		default:
+			return fmt.Errorf("unknown metric type: %s", m.MType)
+		}
+		req.Metrics = append(req.Metrics, pm)
+	}
+
+	if _, err := client.UpdateMetrics(ctx, req); err != nil {
+		return fmt.Errorf("error sending metrics batch over gRPC: %v", err)
+	}
+	return nil
+}
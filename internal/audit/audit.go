@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Event struct {
+	TS        int64    `json:"ts"`
+	Metrics   []string `json:"metrics"`
+	IPAddress string   `json:"ip_address"`
+}
+
+func NewEvent(metrics []string, ip string) Event {
+	return Event{TS: time.Now().Unix(), Metrics: metrics, IPAddress: ip}
+}
+
+// Observer receives audit events. Each observer is fed from its own goroutine,
+// so a slow observer delays only itself.
+type Observer interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+type subscription struct {
+	observer Observer
+	events   chan Event
+	done     chan struct{}
+}
+
+// Publisher fans events out to observers without blocking the caller. Events
+// that do not fit into an observer's buffer are dropped and counted.
+type Publisher struct {
+	bufSize int
+	onError func(err error)
+
+	mu      sync.RWMutex
+	closed  bool
+	subs    []*subscription
+	dropped atomic.Int64
+}
+
+func NewPublisher(bufSize int, onError func(err error)) *Publisher {
+	return &Publisher{bufSize: bufSize, onError: onError}
+}
+
+func (p *Publisher) Subscribe(o Observer) {
+	s := &subscription{observer: o, events: make(chan Event, p.bufSize), done: make(chan struct{})}
+
+	p.mu.Lock()
+	p.subs = append(p.subs, s)
+	p.mu.Unlock()
+
+	go func() {
+		defer close(s.done)
+		for e := range s.events {
+			if err := o.Notify(context.Background(), e); err != nil && p.onError != nil {
+				p.onError(err)
+			}
+		}
+	}()
+}
+
+func (p *Publisher) Publish(e Event) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return
+	}
+	for _, s := range p.subs {
+		select {
+		case s.events <- e:
+		default:
+			p.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of events lost because an observer fell behind.
+func (p *Publisher) Dropped() int64 {
+	return p.dropped.Load()
+}
+
+// Close stops accepting events and waits for observers to process the ones
+// already published.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, s := range p.subs {
+			close(s.events)
+		}
+	}
+	subs := p.subs
+	p.mu.Unlock()
+
+	for _, s := range subs {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+	block  chan struct{}
+}
+
+func (r *recorder) Notify(ctx context.Context, e Event) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+func TestPublisherFansOut(t *testing.T) {
+	p := NewPublisher(10, nil)
+	a, b := &recorder{}, &recorder{}
+	p.Subscribe(a)
+	p.Subscribe(b)
+
+	p.Publish(NewEvent([]string{"Alloc"}, "10.0.0.1"))
+	p.Publish(NewEvent([]string{"PollCount", "Alloc"}, "10.0.0.2"))
+	require.NoError(t, p.Close(context.Background()))
+
+	for _, r := range []*recorder{a, b} {
+		require.Len(t, r.events, 2)
+		assert.Equal(t, []string{"PollCount", "Alloc"}, r.events[1].Metrics)
+		assert.Equal(t, "10.0.0.2", r.events[1].IPAddress)
+	}
+	p.Publish(NewEvent([]string{"Alloc"}, "10.0.0.1"))
+}
+
+func TestPublisherDropsForSlowObserver(t *testing.T) {
+	p := NewPublisher(1, nil)
+	slow := &recorder{block: make(chan struct{})}
+	p.Subscribe(slow)
+
+	for i := 0; i < 10; i++ {
+		p.Publish(NewEvent([]string{"Alloc"}, "10.0.0.1"))
+	}
+	assert.GreaterOrEqual(t, p.Dropped(), int64(8), "publishing must not wait for a blocked observer")
+
+	close(slow.block)
+	require.NoError(t, p.Close(context.Background()))
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Notify(context.Background(), Event{TS: 1700000000, Metrics: []string{"Alloc"}, IPAddress: "10.0.0.1"}))
+		require.NoError(t, sink.Close())
+	}
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		assert.Equal(t, Event{TS: 1700000000, Metrics: []string{"Alloc"}, IPAddress: "10.0.0.1"}, e)
+		lines++
+	}
+	assert.Equal(t, 2, lines, "the file is appended to, not truncated")
+}
@@ -0,0 +1,121 @@
+package broadcast
+
+import (
+	"sync"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+// Subscription receives published metrics accepted by its filter on C. C is
+// closed when the subscriber is dropped for falling behind or unsubscribes.
+type Subscription struct {
+	C      <-chan models.Metrics
+	ch     chan models.Metrics
+	filter func(m models.Metrics) bool
+}
+
+// Broadcaster fans published metrics out to subscribers. Publishing never
+// blocks: a subscriber whose buffer is full is dropped instead.
+type Broadcaster struct {
+	bufSize int
+
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+	done   chan struct{}
+}
+
+func New(bufSize int) *Broadcaster {
+	return &Broadcaster{bufSize: bufSize, subs: make(map[*Subscription]struct{}), done: make(chan struct{})}
+}
+
+// Close ends every subscription, including future ones, so that long-lived
+// streams let the server shut down.
+func (b *Broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.done)
+	for s := range b.subs {
+		b.remove(s)
+	}
+}
+
+// Done is closed by Close.
+func (b *Broadcaster) Done() <-chan struct{} {
+	return b.done
+}
+
+// Subscribe registers a subscriber; a nil filter accepts every metric.
+func (b *Broadcaster) Subscribe(filter func(m models.Metrics) bool) *Subscription {
+	ch := make(chan models.Metrics, b.bufSize)
+	s := &Subscription{C: ch, ch: ch, filter: filter}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *Broadcaster) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(s)
+}
+
+func (b *Broadcaster) remove(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+func (b *Broadcaster) HasSubscribers() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs) > 0
+}
+
+func (b *Broadcaster) Publish(metrics ...models.Metrics) {
+	var slow []*Subscription
+
+	b.mu.RLock()
+	for s := range b.subs {
+		if !s.send(metrics) {
+			slow = append(slow, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	if len(slow) == 0 {
+		return
+	}
+	b.mu.Lock()
+	for _, s := range slow {
+		b.remove(s)
+	}
+	b.mu.Unlock()
+}
+
+// send delivers the metrics accepted by the filter and reports false if the
+// subscriber's buffer overflowed.
+func (s *Subscription) send(metrics []models.Metrics) bool {
+	for _, m := range metrics {
+		if s.filter != nil && !s.filter(m) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package broadcast
+
+import (
+	"testing"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drain(s *Subscription) []string {
+	var ids []string
+	for {
+		select {
+		case m, ok := <-s.C:
+			if !ok {
+				return ids
+			}
+			ids = append(ids, m.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestBroadcasterFansOut(t *testing.T) {
+	b := New(10)
+	all := b.Subscribe(nil)
+	alloc := b.Subscribe(func(m models.Metrics) bool { return m.ID == "Alloc" })
+	require.True(t, b.HasSubscribers())
+
+	b.Publish(storagetest.Gauge("Alloc", 1), storagetest.Gauge("Frees", 2))
+	b.Publish(storagetest.Gauge("Alloc", 3))
+
+	assert.Equal(t, []string{"Alloc", "Frees", "Alloc"}, drain(all))
+	assert.Equal(t, []string{"Alloc", "Alloc"}, drain(alloc))
+
+	b.Unsubscribe(all)
+	b.Unsubscribe(all)
+	_, ok := <-all.C
+	assert.False(t, ok, "unsubscribing closes the channel")
+	b.Unsubscribe(alloc)
+	assert.False(t, b.HasSubscribers())
+}
+
+func TestBroadcasterDropsSlowSubscribers(t *testing.T) {
+	b := New(2)
+	slow := b.Subscribe(nil)
+	fast := b.Subscribe(nil)
+
+	for i := 0; i < 3; i++ {
+		b.Publish(storagetest.Gauge("Alloc", float64(i)))
+		drain(fast)
+	}
+
+	assert.Equal(t, []string{"Alloc", "Alloc"}, drain(slow), "buffered metrics are still delivered")
+	_, ok := <-slow.C
+	assert.False(t, ok, "slow subscriber is dropped")
+
+	b.Publish(storagetest.Gauge("Alloc", 4))
+	assert.Equal(t, []string{"Alloc"}, drain(fast))
+	assert.True(t, b.HasSubscribers())
+}
+
+func TestBroadcasterClose(t *testing.T) {
+	b := New(10)
+	s := b.Subscribe(nil)
+	b.Close()
+	b.Close()
+
+	_, ok := <-s.C
+	assert.False(t, ok)
+	_, ok = <-b.Subscribe(nil).C
+	assert.False(t, ok, "subscriptions after Close are already closed")
+	<-b.Done()
+	assert.False(t, b.HasSubscribers())
+	b.Publish(storagetest.Gauge("Alloc", 1))
+}
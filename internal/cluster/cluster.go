@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+// ForwardedHeader marks requests one node sends to another, which must be
+// answered from local storage even if the rings disagree.
+const ForwardedHeader = "X-Cluster-Forwarded"
+
+type Cluster struct {
+	Ring *Ring
+	// Self is this node's address exactly as it appears in the node list.
+	Self   string
+	client *http.Client
+}
+
+func New(self string, nodes []string) *Cluster {
+	return &Cluster{
+		Ring:   NewRing(nodes, DefaultVirtualNodes),
+		Self:   self,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *Cluster) IsLocal(owner string) bool {
+	return owner == c.Self
+}
+
+func (c *Cluster) FetchValue(ctx context.Context, node, metricType, name string) (models.Metrics, error) {
+	var m models.Metrics
+	path := "/api/cluster/value/" + url.PathEscape(metricType) + "/" + url.PathEscape(name)
+	err := c.call(ctx, node, http.MethodGet, path, nil, &m)
+	return m, err
+}
+
+func (c *Cluster) FetchValues(ctx context.Context, node string, metrics []models.Metrics) ([]models.Metrics, error) {
+	var res ValuesResponse
+	if err := c.call(ctx, node, http.MethodPost, "/api/cluster/values", metrics, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Errors) > 0 {
+		return res.Metrics, fmt.Errorf("%w: %s: %v", storage.ErrUnavailable, node, res.Errors)
+	}
+	return res.Metrics, nil
+}
+
+// ValuesResponse is returned by the fan-out values endpoint. Metrics that do
+// not exist are omitted; nodes that could not be queried are listed in Errors.
+type ValuesResponse struct {
+	Metrics []models.Metrics `json:"metrics"`
+	Errors  []string         `json:"errors,omitempty"`
+}
+
+func (c *Cluster) call(ctx context.Context, node, method, path string, body, out any) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+node+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedHeader, c.Self)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotFound:
+		return storage.ErrNotFound
+	default:
+		return fmt.Errorf("%w: %s returned %s", storage.ErrUnavailable, node, resp.Status)
+	}
+}
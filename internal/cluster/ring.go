@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+// DefaultVirtualNodes is the number of points each node gets on the ring.
+// Agents and servers must use the same value to agree on ownership.
+const DefaultVirtualNodes = 128
+
+// Ring assigns metric names to nodes by consistent hashing, so adding or
+// removing a node only moves the names in its share of the ring.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []point
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV alone spreads similar short keys poorly; finish with splitmix64.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ParseNodes splits a comma-separated list of node addresses.
+func ParseNodes(s string) []string {
+	var nodes []string
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func NewRing(nodes []string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{vnodes: vnodes}
+
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		r.nodes = append(r.nodes, n)
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, point{hash: hash(n + "#" + strconv.Itoa(i)), node: n})
+		}
+	}
+	sort.Strings(r.nodes)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r
+}
+
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+func (r *Ring) VirtualNodes() int {
+	return r.vnodes
+}
+
+// Owner returns the node responsible for the metric name, or "" for an empty
+// ring.
+func (r *Ring) Owner(name string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(name)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Shares returns the fraction of the hash space owned by each node.
+func (r *Ring) Shares() map[string]float64 {
+	shares := make(map[string]float64, len(r.nodes))
+	if len(r.points) == 0 {
+		return shares
+	}
+	const space = float64(1<<63) * 2
+	prev := r.points[len(r.points)-1].hash
+	for _, p := range r.points {
+		// Unsigned subtraction wraps around for the first point.
+		shares[p.node] += float64(p.hash-prev) / space
+		prev = p.hash
+	}
+	return shares
+}
+
+// Split groups metrics by owning node.
+func (r *Ring) Split(metrics []models.Metrics) map[string][]models.Metrics {
+	parts := make(map[string][]models.Metrics)
+	for _, m := range metrics {
+		owner := r.Owner(m.ID)
+		parts[owner] = append(parts[owner], m)
+	}
+	return parts
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingOwnership(t *testing.T) {
+	nodes := []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}
+	ring := NewRing(nodes, DefaultVirtualNodes)
+	reordered := NewRing([]string{nodes[2], nodes[0], nodes[1], nodes[0]}, DefaultVirtualNodes)
+
+	counts := make(map[string]int)
+	const names = 30000
+	for i := 0; i < names; i++ {
+		name := fmt.Sprintf("host%d_metric%d", i%100, i)
+		owner := ring.Owner(name)
+		require.Equal(t, owner, reordered.Owner(name), "ownership must not depend on node order")
+		counts[owner]++
+	}
+	for _, n := range nodes {
+		assert.InDelta(t, names/3, counts[n], names/10, "node %s owns an unbalanced share", n)
+	}
+
+	var total float64
+	for _, share := range ring.Shares() {
+		total += share
+	}
+	assert.InDelta(t, 1.0, total, 1e-9)
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	before := NewRing([]string{"a:1", "b:1", "c:1"}, DefaultVirtualNodes)
+	after := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, DefaultVirtualNodes)
+
+	moved := 0
+	const names = 10000
+	for i := 0; i < names; i++ {
+		name := fmt.Sprintf("metric%d", i)
+		from, to := before.Owner(name), after.Owner(name)
+		if from != to {
+			moved++
+			assert.Equal(t, "d:1", to, "names only move to the new node")
+		}
+	}
+	assert.InDelta(t, names/4, moved, names/10)
+}
+
+func TestParseNodes(t *testing.T) {
+	assert.Equal(t, []string{"a:1", "b:2"}, ParseNodes(" a:1, ,b:2,"))
+	assert.Empty(t, ParseNodes(""))
+	assert.Equal(t, "", NewRing(nil, 0).Owner("Alloc"))
+}
@@ -1,17 +1,91 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
-func New(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", dsn)
+type Config struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// StatementTimeout is sent to Postgres as statement_timeout for every
+	// connection in the pool; zero keeps the server default.
+	StatementTimeout time.Duration
+	ConnectTimeout   time.Duration
+	// StartupTimeout is how long Open keeps retrying the initial ping while
+	// the database is coming up.
+	StartupTimeout time.Duration
+}
+
+func DefaultConfig(dsn string) Config {
+	return Config{
+		DSN:             dsn,
+		MaxOpenConns:    20,
+		MaxIdleConns:    10,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnectTimeout:  5 * time.Second,
+		StartupTimeout:  30 * time.Second,
+	}
+}
+
+func connConfig(cfg Config) (*pgx.ConnConfig, error) {
+	connCfg, err := pgx.ParseConfig(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DSN: %w", err)
+	}
+	if cfg.ConnectTimeout > 0 {
+		connCfg.ConnectTimeout = cfg.ConnectTimeout
+	}
+	if cfg.StatementTimeout > 0 {
+		connCfg.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+	return connCfg, nil
+}
+
+func Open(ctx context.Context, cfg Config) (*sql.DB, error) {
+	connCfg, err := connConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	if err = db.Ping(); err != nil {
+
+	db := stdlib.OpenDB(*connCfg)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	if err := waitReady(ctx, db, cfg.StartupTimeout); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, nil
 }
+
+func waitReady(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	delay := 500 * time.Millisecond
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("failed to ping DB: %w", err)
+		case <-timer.C:
+		}
+		delay = min(2*delay, 5*time.Second)
+	}
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Listener keeps a dedicated connection subscribed to a notification channel
+// and reconnects with backoff when the connection is lost.
+type Listener struct {
+	Config  Config
+	Channel string
+	// OnConnect is called every time the subscription is (re)established.
+	// Notifications sent while disconnected are lost, so this is the place to
+	// resynchronize.
+	OnConnect func()
+	OnNotify  func(payload string)
+	OnError   func(err error)
+}
+
+func (l *Listener) Run(ctx context.Context) {
+	delay := time.Second
+	for {
+		err := l.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if l.OnError != nil {
+			l.OnError(err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		delay = min(2*delay, 30*time.Second)
+	}
+}
+
+func (l *Listener) listen(ctx context.Context) error {
+	connCfg, err := connConfig(l.Config)
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, connCfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{l.Channel}.Sanitize()); err != nil {
+		return err
+	}
+	if l.OnConnect != nil {
+		l.OnConnect()
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if l.OnNotify != nil {
+			l.OnNotify(n.Payload)
+		}
+	}
+}
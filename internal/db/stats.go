@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+type batchAdder interface {
+	AddBatch(ctx context.Context, metrics []models.Metrics) error
+}
+
+// PoolMetrics converts pool statistics into gauges named instance/DB...,
+// so that servers sharing a database don't overwrite each other's stats.
+// Cumulative values are reported as gauges as well so that each report is
+// idempotent.
+func PoolMetrics(instance string, stats sql.DBStats) []models.Metrics {
+	gauge := func(id string, v float64) models.Metrics {
+		id = instance + "/" + id
+		return models.Metrics{ID: id, MType: "gauge", Value: &v}
+	}
+	return []models.Metrics{
+		gauge("DBMaxOpenConnections", float64(stats.MaxOpenConnections)),
+		gauge("DBOpenConnections", float64(stats.OpenConnections)),
+		gauge("DBInUse", float64(stats.InUse)),
+		gauge("DBIdle", float64(stats.Idle)),
+		gauge("DBWaitCount", float64(stats.WaitCount)),
+		gauge("DBWaitDurationMs", float64(stats.WaitDuration.Milliseconds())),
+		gauge("DBMaxIdleClosed", float64(stats.MaxIdleClosed)),
+		gauge("DBMaxLifetimeClosed", float64(stats.MaxLifetimeClosed)),
+	}
+}
+
+// ReportStats writes pool statistics of db into repo every interval until ctx
+// is done.
+func ReportStats(ctx context.Context, db *sql.DB, repo batchAdder, instance string, interval time.Duration, onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := repo.AddBatch(ctx, PoolMetrics(instance, db.Stats())); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+const pageSize = 1000
+
+// Source is a downstream server whose metrics are stored as
+// "<Name>/<metric>".
+type Source struct {
+	Name    string
+	Address string
+}
+
+// ParseSources parses a comma-separated list of "name=host:port" entries. An
+// entry without a name uses its address as the name.
+func ParseSources(s string) ([]Source, error) {
+	var sources []Source
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		src := Source{Name: entry, Address: entry}
+		if name, addr, ok := strings.Cut(entry, "="); ok {
+			src = Source{Name: strings.TrimSpace(name), Address: strings.TrimSpace(addr)}
+		}
+		if src.Name == "" || src.Address == "" {
+			return nil, fmt.Errorf("invalid federation source: %q", entry)
+		}
+		if seen[src.Name] {
+			return nil, fmt.Errorf("duplicate federation source: %s", src.Name)
+		}
+		seen[src.Name] = true
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+type Config struct {
+	Sources  []Source
+	Interval time.Duration
+	Client   *http.Client
+	OnError  func(source string, err error)
+}
+
+// Puller periodically copies the metrics of downstream servers into a local
+// repository. Gauges are copied as is; counters are converted back into deltas
+// so that the local counter follows the downstream one.
+type Puller struct {
+	repo storage.Repository
+	cfg  Config
+
+	mu sync.Mutex
+	// seen holds the last downstream value of every counter per source.
+	seen map[string]map[string]int64
+}
+
+func NewPuller(repo storage.Repository, cfg Config) *Puller {
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Puller{repo: repo, cfg: cfg, seen: make(map[string]map[string]int64)}
+}
+
+func (p *Puller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.PullAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Puller) PullAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, src := range p.cfg.Sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Pull(ctx, src); err != nil && ctx.Err() == nil && p.cfg.OnError != nil {
+				p.cfg.OnError(src.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Puller) Pull(ctx context.Context, src Source) error {
+	metrics, err := p.fetch(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen := p.seen[src.Name]
+
+	batch := make([]models.Metrics, 0, len(metrics))
+	next := make(map[string]int64)
+	for _, m := range metrics {
+		id := src.Name + "/" + m.ID
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			batch = append(batch, models.Metrics{ID: id, MType: "gauge", Value: m.Value})
+		case m.MType == "counter" && m.Delta != nil:
+			next[m.ID] = *m.Delta
+			last, ok := seen[m.ID]
+			if !ok {
+				last, err = p.localCounter(ctx, id)
+				if err != nil {
+					return err
+				}
+			}
+			d := *m.Delta - last
+			if d < 0 {
+				// The downstream counter was reset, e.g. by a restart.
+				d = *m.Delta
+			}
+			if d != 0 {
+				batch = append(batch, models.Metrics{ID: id, MType: "counter", Delta: &d})
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := p.repo.AddBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to store metrics from %s: %w", src.Name, err)
+		}
+	}
+	p.seen[src.Name] = next
+	return nil
+}
+
+// localCounter is used as the baseline for counters not seen since start, so
+// that restarting the federating server does not count them twice.
+func (p *Puller) localCounter(ctx context.Context, id string) (int64, error) {
+	m, err := p.repo.Get(ctx, "counter", id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return *m.Delta, nil
+}
+
+// fetch reads the full listing of src, following pagination cursors.
+func (p *Puller) fetch(ctx context.Context, src Source) ([]models.Metrics, error) {
+	var all []models.Metrics
+	cursor := ""
+	for {
+		page, next, err := p.fetchPage(ctx, src, cursor)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if next == "" {
+			return all, nil
+		}
+		cursor = next
+	}
+}
+
+func (p *Puller) fetchPage(ctx context.Context, src Source, cursor string) ([]models.Metrics, string, error) {
+	q := url.Values{"limit": {strconv.Itoa(pageSize)}}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+src.Address+"/api/metrics?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned %s", src.Address, resp.Status)
+	}
+	var metrics []models.Metrics
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		return nil, "", fmt.Errorf("invalid metrics listing from %s: %w", src.Address, err)
+	}
+	return metrics, resp.Header.Get(models.NextCursorHeader), nil
+}
@@ -0,0 +1,104 @@
+package federation
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/handlers"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func startDownstream(t *testing.T, repo storage.Repository) string {
+	t.Helper()
+	r := chi.NewRouter()
+	handlers.NewHandler(repo, zap.NewNop().Sugar()).RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func get(t *testing.T, repo storage.Repository, mtype, id string) models.Metrics {
+	t.Helper()
+	m, err := repo.Get(context.Background(), mtype, id)
+	require.NoError(t, err)
+	return m
+}
+
+func TestPuller(t *testing.T) {
+	ctx := context.Background()
+	downstream := storage.NewMemStorage()
+	src := Source{Name: "dc1", Address: startDownstream(t, downstream)}
+
+	local := storage.NewMemStorage()
+	require.NoError(t, local.Add(ctx, storagetest.Counter("dc1/PollCount", 3)), "value kept from before a restart")
+
+	require.NoError(t, downstream.AddBatch(ctx, []models.Metrics{storagetest.Gauge("Alloc", 1.5), storagetest.Counter("PollCount", 5)}))
+	p := NewPuller(local, Config{Sources: []Source{src}})
+
+	require.NoError(t, p.Pull(ctx, src))
+	assert.Equal(t, 1.5, *get(t, local, "gauge", "dc1/Alloc").Value)
+	assert.Equal(t, int64(5), *get(t, local, "counter", "dc1/PollCount").Delta)
+
+	require.NoError(t, p.Pull(ctx, src))
+	assert.Equal(t, int64(5), *get(t, local, "counter", "dc1/PollCount").Delta, "unchanged counters are not added again")
+
+	require.NoError(t, downstream.Add(ctx, storagetest.Counter("PollCount", 2)))
+	require.NoError(t, p.Pull(ctx, src))
+	assert.Equal(t, int64(7), *get(t, local, "counter", "dc1/PollCount").Delta)
+
+	// Downstream restarted and counts from zero again.
+	downstream.Restore([]models.Metrics{storagetest.Counter("PollCount", 1)})
+	require.NoError(t, p.Pull(ctx, src))
+	assert.Equal(t, int64(8), *get(t, local, "counter", "dc1/PollCount").Delta)
+}
+
+func TestPullerReportsUnreachableSource(t *testing.T) {
+	var failed []string
+	p := NewPuller(storage.NewMemStorage(), Config{
+		Sources: []Source{{Name: "dc2", Address: "127.0.0.1:1"}},
+		OnError: func(source string, err error) { failed = append(failed, source) },
+	})
+	p.PullAll(context.Background())
+	assert.Equal(t, []string{"dc2"}, failed)
+}
+
+func TestParseSources(t *testing.T) {
+	sources, err := ParseSources("dc1=10.0.0.1:8080, 10.0.0.2:8080")
+	require.NoError(t, err)
+	assert.Equal(t, []Source{
+		{Name: "dc1", Address: "10.0.0.1:8080"},
+		{Name: "10.0.0.2:8080", Address: "10.0.0.2:8080"},
+	}, sources)
+
+	_, err = ParseSources("dc1=a:1,dc1=b:1")
+	assert.Error(t, err)
+	_, err = ParseSources("=a:1")
+	assert.Error(t, err)
+}
+
+func TestPullerFollowsPages(t *testing.T) {
+	ctx := context.Background()
+	downstream := storage.NewMemStorage()
+	var batch []models.Metrics
+	for i := 0; i < pageSize*2+10; i++ {
+		batch = append(batch, storagetest.Gauge(fmt.Sprintf("Metric%04d", i), float64(i)))
+	}
+	require.NoError(t, downstream.AddBatch(ctx, batch))
+
+	src := Source{Name: "dc1", Address: startDownstream(t, downstream)}
+	local := storage.NewMemStorage()
+	require.NoError(t, NewPuller(local, Config{}).Pull(ctx, src))
+
+	all, err := local.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, len(batch))
+	assert.Equal(t, 2009.0, *get(t, local, "gauge", "dc1/Metric2009").Value)
+}
@@ -0,0 +1,189 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	pb "github.com/kosta324/metrics.git/internal/proto"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+
+	Repo   storage.Repository
+	logger *zap.SugaredLogger
+	notify func(ip string, metrics ...models.Metrics)
+}
+
+func NewMetricsServer(repo storage.Repository, log *zap.SugaredLogger) *MetricsServer {
+	return &MetricsServer{
+		Repo:   repo,
+		logger: log,
+	}
+}
+
+// SetNotifier registers fn to be called with the peer address and the metrics
+// of every accepted update.
+func (s *MetricsServer) SetNotifier(fn func(ip string, metrics ...models.Metrics)) {
+	s.notify = fn
+}
+
+func (s *MetricsServer) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	if len(in.GetMetrics()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty metrics batch")
+	}
+	if err := s.addBatch(ctx, in.GetMetrics()); err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+func (s *MetricsServer) UpdateMetricsStream(stream pb.Metrics_UpdateMetricsStreamServer) error {
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.UpdateMetricsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.addBatch(stream.Context(), in.GetMetrics()); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *MetricsServer) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	if in.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "metric id required")
+	}
+	metricType, err := typeToModel(in.GetType())
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.Repo.Get(ctx, metricType, in.GetId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &pb.GetMetricResponse{Metric: metricToProto(m)}, nil
+}
+
+func (s *MetricsServer) ListMetrics(ctx context.Context, in *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	metrics, err := s.Repo.GetAll(ctx)
+	if err != nil {
+		s.logger.Errorf("failed to list metrics: %v", err)
+		return nil, statusFromError(err)
+	}
+
+	resp := &pb.ListMetricsResponse{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		resp.Metrics = append(resp.Metrics, metricToProto(m))
+	}
+	sort.Slice(resp.Metrics, func(i, j int) bool {
+		return resp.Metrics[i].GetId() < resp.Metrics[j].GetId()
+	})
+	return resp, nil
+}
+
+func (s *MetricsServer) addBatch(ctx context.Context, in []*pb.Metric) error {
+	metrics := make([]models.Metrics, 0, len(in))
+	for _, pm := range in {
+		if pm.GetId() == "" {
+			return status.Error(codes.InvalidArgument, "metric id required")
+		}
+		m := models.Metrics{ID: pm.GetId()}
+		switch pm.GetType() {
+		case pb.Metric_GAUGE:
+			v := pm.GetValue()
+			m.MType = "gauge"
+			m.Value = &v
+		case pb.Metric_COUNTER:
+			d := pm.GetDelta()
+			m.MType = "counter"
+			m.Delta = &d
+		case pb.Metric_MTYPE_UNSPECIFIED:
+			return status.Error(codes.InvalidArgument, "metric type required")
+		default:
+			return status.Error(codes.Unimplemented, "unknown metric type")
+		}
+		metrics = append(metrics, m)
+	}
+
+	if err := s.Repo.AddBatch(ctx, metrics); err != nil {
+		s.logger.Errorf("failed to store metrics batch: %v", err)
+		return statusFromError(err)
+	}
+	if s.notify != nil {
+		s.notify(peerIP(ctx), metrics...)
+	}
+	return nil
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func statusFromError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, storage.ErrUnsupportedType):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, storage.ErrInvalidValue):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, storage.ErrOverloaded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, storage.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func typeToModel(t pb.Metric_MType) (string, error) {
+	switch t {
+	case pb.Metric_GAUGE:
+		return "gauge", nil
+	case pb.Metric_COUNTER:
+		return "counter", nil
+	case pb.Metric_MTYPE_UNSPECIFIED:
+		return "", status.Error(codes.InvalidArgument, "metric type required")
+	default:
+		return "", status.Error(codes.Unimplemented, "unknown metric type")
+	}
+}
+
+func metricToProto(m models.Metrics) *pb.Metric {
+	pm := &pb.Metric{Id: m.ID}
+	switch m.MType {
+	case "gauge":
+		pm.Type = pb.Metric_GAUGE
+		if m.Value != nil {
+			pm.Value = *m.Value
+		}
+	case "counter":
+		pm.Type = pb.Metric_COUNTER
+		if m.Delta != nil {
+			pm.Delta = *m.Delta
+		}
+	}
+	return pm
+}
@@ -0,0 +1,138 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	pb "github.com/kosta324/metrics.git/internal/proto"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func setupClient(t *testing.T) pb.MetricsClient {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err, "failed to create logger")
+	return serve(t, NewMetricsServer(storage.NewMemStorage(), logger.Sugar()))
+}
+
+func serve(t *testing.T, s *MetricsServer) pb.MetricsClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	pb.RegisterMetricsServer(server, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn)
+}
+
+func TestUpdateAndGetMetrics(t *testing.T) {
+	client := setupClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "HeapAlloc", Type: pb.Metric_GAUGE, Value: 123.45},
+		{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 5},
+	}})
+	require.NoError(t, err)
+
+	stream, err := client.UpdateMetricsStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+			{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 1},
+		}}))
+	}
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), resp.GetMetric().GetDelta())
+
+	resp, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "HeapAlloc", Type: pb.Metric_GAUGE})
+	require.NoError(t, err)
+	assert.InDelta(t, 123.45, resp.GetMetric().GetValue(), 0.0001)
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Unknown", Type: pb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 2)
+	assert.Equal(t, "HeapAlloc", list.GetMetrics()[0].GetId())
+	assert.Equal(t, "PollCount", list.GetMetrics()[1].GetId())
+}
+
+func TestMissingMetricTypeRejected(t *testing.T) {
+	client := setupClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Delta: 5},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, list.GetMetrics())
+}
+
+func TestUpdatesNotify(t *testing.T) {
+	s := NewMetricsServer(storage.NewMemStorage(), zap.NewNop().Sugar())
+	var mu sync.Mutex
+	var notified []models.Metrics
+	s.SetNotifier(func(ip string, metrics ...models.Metrics) {
+		assert.NotEmpty(t, ip)
+		mu.Lock()
+		notified = append(notified, metrics...)
+		mu.Unlock()
+	})
+	client := serve(t, s)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "HeapAlloc", Type: pb.Metric_GAUGE, Value: 1},
+	}})
+	require.NoError(t, err)
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Rejected"},
+	}})
+	require.Error(t, err)
+
+	stream, err := client.UpdateMetricsStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 2},
+	}}))
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, notified, 2)
+	assert.Equal(t, "HeapAlloc", notified[0].ID)
+	assert.Equal(t, "PollCount", notified[1].ID)
+	assert.Equal(t, int64(2), *notified[1].Delta)
+}
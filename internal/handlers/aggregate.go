@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+type aggregateResponse struct {
+	Op    string   `json:"op"`
+	Type  string   `json:"type"`
+	Match string   `json:"match,omitempty"`
+	Count int64    `json:"count"`
+	Value *float64 `json:"value"`
+}
+
+// parseAggregateQuery reads ?match= as a glob, or as a regular expression
+// when it is enclosed in slashes. The type defaults to gauge.
+func parseAggregateQuery(q url.Values) (storage.AggregateQuery, error) {
+	aq := storage.AggregateQuery{Op: q.Get("op"), Type: q.Get("type")}
+	if aq.Type == "" {
+		aq.Type = "gauge"
+	}
+	if aq.Type != "gauge" && aq.Type != "counter" {
+		return aq, errors.New("type must be gauge or counter")
+	}
+	switch aq.Op {
+	case "sum", "avg", "min", "max", "count":
+	default:
+		return aq, errors.New("op must be one of sum, avg, min, max, count")
+	}
+
+	match := q.Get("match")
+	if len(match) >= 2 && strings.HasPrefix(match, "/") && strings.HasSuffix(match, "/") {
+		re, err := regexp.Compile(match[1 : len(match)-1])
+		if err != nil {
+			return aq, errors.New("invalid regex: " + err.Error())
+		}
+		aq.Regex = re
+	} else {
+		aq.Glob = match
+	}
+	return aq, nil
+}
+
+func (h *Handler) AggregateMetrics(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAggregateQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	agg, err := storage.AggregateMetrics(r.Context(), h.Repo, q)
+	if err != nil {
+		h.writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aggregateResponse{
+		Op:    q.Op,
+		Type:  q.Type,
+		Match: r.URL.Query().Get("match"),
+		Count: agg.Count,
+		Value: agg.Value,
+	})
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAggregateMetrics(t *testing.T) {
+	repo := storage.NewMemStorage()
+	require.NoError(t, repo.AddBatch(t.Context(), []models.Metrics{
+		storagetest.Gauge("dc1/HeapAlloc", 100), storagetest.Gauge("dc2/HeapAlloc", 300), storagetest.Gauge("HeapAlloc", 50),
+		storagetest.Counter("dc1/PollCount", 4), storagetest.Counter("dc2/PollCount", 6),
+	}))
+	r := chi.NewRouter()
+	NewHandler(repo, zap.NewNop().Sugar()).RegisterRoutes(r)
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"?op=sum&match=*/HeapAlloc", http.StatusOK, `{"op":"sum","type":"gauge","match":"*/HeapAlloc","count":2,"value":400}`},
+		{"?op=avg&match=*HeapAlloc", http.StatusOK, `{"op":"avg","type":"gauge","match":"*HeapAlloc","count":3,"value":150}`},
+		{"?op=max&match=/^dc\\d/&type=counter", http.StatusOK, `{"op":"max","type":"counter","match":"/^dc\\d/","count":2,"value":6}`},
+		{"?op=count", http.StatusOK, `{"op":"count","type":"gauge","count":3,"value":3}`},
+		{"?op=min&match=none", http.StatusOK, `{"op":"min","type":"gauge","match":"none","count":0,"value":null}`},
+		{"?op=median", http.StatusBadRequest, ""},
+		{"?op=sum&type=histogram", http.StatusBadRequest, ""},
+		{"?op=sum&match=/(/", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/aggregate"+tt.query, nil))
+			assert.Equal(t, tt.status, w.Code)
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
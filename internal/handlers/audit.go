@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/kosta324/metrics.git/internal/audit"
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+func (h *Handler) SetAudit(p *audit.Publisher) {
+	h.audit = p
+}
+
+func (h *Handler) auditUpdate(r *http.Request, metrics ...models.Metrics) {
+	if h.audit == nil {
+		return
+	}
+	h.auditFrom(h.clientIP(r), metrics...)
+}
+
+func (h *Handler) auditFrom(ip string, metrics ...models.Metrics) {
+	if h.audit == nil {
+		return
+	}
+	names := make([]string, len(metrics))
+	for i, m := range metrics {
+		names[i] = m.ID
+	}
+	h.audit.Publish(audit.NewEvent(names, ip))
+}
+
+// NotifyUpdate audits and publishes updates accepted outside the HTTP
+// handlers, e.g. over gRPC.
+func (h *Handler) NotifyUpdate(ip string, metrics ...models.Metrics) {
+	h.auditFrom(ip, metrics...)
+	h.publishUpdate(metrics...)
+}
+
+// SetTrustedProxies lists the peers allowed to report the client address in
+// X-Real-IP; the header is ignored from anyone else.
+func (h *Handler) SetTrustedProxies(proxies []netip.Prefix) {
+	h.trustedProxies = proxies
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// prefixes.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(p); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// clientIP takes X-Real-IP over the peer address only when the peer is a
+// trusted proxy, since anyone else could put any address there.
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := r.Header.Get("X-Real-IP")
+	if ip == "" {
+		return host
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	for _, p := range h.trustedProxies {
+		if p.Contains(peer.Unmap()) {
+			return ip
+		}
+	}
+	return host
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/cluster"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+func (h *Handler) SetCluster(c *cluster.Cluster) {
+	h.cluster = c
+}
+
+type clusterNode struct {
+	Address string  `json:"address"`
+	Share   float64 `json:"share"`
+}
+
+type clusterInfo struct {
+	Self         string        `json:"self"`
+	VirtualNodes int           `json:"virtual_nodes"`
+	Nodes        []clusterNode `json:"nodes"`
+	Owner        string        `json:"owner,omitempty"`
+}
+
+func (h *Handler) ClusterInfo(w http.ResponseWriter, r *http.Request) {
+	if h.cluster == nil {
+		writeError(w, http.StatusNotFound, "cluster mode is disabled")
+		return
+	}
+
+	ring := h.cluster.Ring
+	shares := ring.Shares()
+	info := clusterInfo{Self: h.cluster.Self, VirtualNodes: ring.VirtualNodes()}
+	for _, n := range ring.Nodes() {
+		info.Nodes = append(info.Nodes, clusterNode{Address: n, Share: shares[n]})
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		info.Owner = ring.Owner(name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// local reports whether a request must be answered from this node's storage.
+func (h *Handler) local(r *http.Request, owner string) bool {
+	return h.cluster == nil || h.cluster.IsLocal(owner) || r.Header.Get(cluster.ForwardedHeader) != ""
+}
+
+func (h *Handler) ClusterValue(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	name, err := wildcardName(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid metric name")
+		return
+	}
+
+	var m models.Metrics
+	if owner := h.ownerOf(name); h.local(r, owner) {
+		m, err = h.Repo.Get(r.Context(), metricType, name)
+	} else {
+		m, err = h.cluster.FetchValue(r.Context(), owner, metricType, name)
+	}
+	if err != nil {
+		h.writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// wildcardName returns the metric name matched by a trailing * in the route,
+// so that names may contain "/". chi matches escaped paths as sent, so names
+// with escaped characters such as %2F are unescaped here.
+func wildcardName(r *http.Request) (string, error) {
+	name := chi.URLParam(r, "*")
+	if r.URL.RawPath == "" {
+		return name, nil
+	}
+	return url.PathUnescape(name)
+}
+
+func (h *Handler) ownerOf(name string) string {
+	if h.cluster == nil {
+		return ""
+	}
+	return h.cluster.Ring.Owner(name)
+}
+
+// ClusterValues gathers the requested metrics from the nodes owning them.
+func (h *Handler) ClusterValues(w http.ResponseWriter, r *http.Request) {
+	var wanted []models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&wanted); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON array")
+		return
+	}
+
+	parts := map[string][]models.Metrics{"": wanted}
+	if h.cluster != nil && r.Header.Get(cluster.ForwardedHeader) == "" {
+		parts = h.cluster.Ring.Split(wanted)
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		res = cluster.ValuesResponse{Metrics: []models.Metrics{}}
+	)
+	for owner, part := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var found []models.Metrics
+			var err error
+			if h.local(r, owner) {
+				found, err = h.getLocal(r, part)
+			} else {
+				found, err = h.cluster.FetchValues(r.Context(), owner, part)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Metrics = append(res.Metrics, found...)
+			if err != nil {
+				res.Errors = append(res.Errors, err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(res.Metrics, func(i, j int) bool {
+		if res.Metrics[i].ID != res.Metrics[j].ID {
+			return res.Metrics[i].ID < res.Metrics[j].ID
+		}
+		return res.Metrics[i].MType < res.Metrics[j].MType
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) getLocal(r *http.Request, wanted []models.Metrics) ([]models.Metrics, error) {
+	var found []models.Metrics
+	for _, m := range wanted {
+		stored, err := h.Repo.Get(r.Context(), m.MType, m.ID)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrUnsupportedType) {
+			continue
+		}
+		if err != nil {
+			return found, err
+		}
+		found = append(found, stored)
+	}
+	return found, nil
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/cluster"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestClusterFanOut(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err, "failed to create logger")
+	defer logger.Sync()
+
+	servers := make([]*httptest.Server, 3)
+	repos := make([]*storage.MemStorage, 3)
+	var nodes []string
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		nodes = append(nodes, servers[i].Listener.Addr().String())
+	}
+	for i, srv := range servers {
+		repos[i] = storage.NewMemStorage()
+		h := NewHandler(repos[i], logger.Sugar())
+		h.SetCluster(cluster.New(nodes[i], nodes))
+		r := chi.NewRouter()
+		h.RegisterRoutes(r)
+		srv.Config.Handler = r
+		srv.Start()
+		defer srv.Close()
+	}
+
+	// Store every metric only on the node owning it, as sharded agents do.
+	ring := cluster.NewRing(nodes, cluster.DefaultVirtualNodes)
+	var wanted []models.Metrics
+	for i := 0; i < 20; i++ {
+		m := storagetest.Gauge(fmt.Sprintf("Metric%02d", i), float64(i))
+		for j, n := range nodes {
+			if ring.Owner(m.ID) == n {
+				require.NoError(t, repos[j].Add(t.Context(), m))
+			}
+		}
+		wanted = append(wanted, models.Metrics{ID: m.ID, MType: "gauge"})
+	}
+	wanted = append(wanted, models.Metrics{ID: "Missing", MType: "gauge"})
+	// Federated names contain the source, and names may hold URL syntax.
+	odd := []models.Metrics{storagetest.Counter("dc1/PollCount", 3), storagetest.Counter("a?b#c%d", 4)}
+	for _, m := range odd {
+		for j, n := range nodes {
+			if ring.Owner(m.ID) == n {
+				require.NoError(t, repos[j].Add(t.Context(), m))
+			}
+		}
+	}
+
+	t.Run("value from any node", func(t *testing.T) {
+		for _, srv := range servers {
+			resp, err := http.Get(srv.URL + "/api/cluster/value/gauge/Metric07")
+			require.NoError(t, err)
+			var m models.Metrics
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, 7.0, *m.Value)
+		}
+
+		for _, want := range odd {
+			for _, srv := range servers {
+				resp, err := http.Get(srv.URL + "/api/cluster/value/counter/" + url.PathEscape(want.ID))
+				require.NoError(t, err)
+				var m models.Metrics
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode, want.ID)
+				assert.Equal(t, *want.Delta, *m.Delta)
+			}
+		}
+
+		resp, err := http.Get(servers[0].URL + "/api/cluster/value/counter/dc1/PollCount")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "unescaped slashes are part of the name")
+
+		resp, err = http.Get(servers[0].URL + "/api/cluster/value/gauge/Missing")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("batch values", func(t *testing.T) {
+		body, err := json.Marshal(wanted)
+		require.NoError(t, err)
+		resp, err := http.Post(servers[1].URL+"/api/cluster/values", "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var res cluster.ValuesResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Empty(t, res.Errors)
+		require.Len(t, res.Metrics, 20)
+		for i, m := range res.Metrics {
+			assert.Equal(t, fmt.Sprintf("Metric%02d", i), m.ID)
+			assert.Equal(t, float64(i), *m.Value)
+		}
+	})
+
+	t.Run("ring description", func(t *testing.T) {
+		resp, err := http.Get(servers[2].URL + "/api/cluster?name=Metric07")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var info clusterInfo
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		assert.Equal(t, nodes[2], info.Self)
+		assert.Len(t, info.Nodes, 3)
+		assert.Equal(t, ring.Owner("Metric07"), info.Owner)
+	})
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/history"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+const defaultRefresh = 10
+
+var templateFuncs = template.FuncMap{
+	// metricPath escapes a metric name as a single path segment, including the
+	// slashes of federated names.
+	"metricPath": url.PathEscape,
+	"dict": func(kv ...any) map[string]any {
+		m := make(map[string]any, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[kv[i].(string)] = kv[i+1]
+		}
+		return m
+	},
+}
+
+var (
+	indexTemplate  = parsePage("templates/index.html")
+	metricTemplate = parsePage("templates/metric.html")
+)
+
+func parsePage(page string) *template.Template {
+	return template.Must(template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/layout.html", page))
+}
+
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 20
+	chartWidth      = 600
+	chartHeight     = 200
+)
+
+type dashboardRow struct {
+	models.Metrics
+	Chart *chart
+}
+
+type indexPage struct {
+	Gauges   []dashboardRow
+	Counters []dashboardRow
+	Refresh  int
+}
+
+type metricPage struct {
+	Metric   models.Metrics
+	Chart    *chart
+	NotFound bool
+	Refresh  int
+}
+
+func (h *Handler) SetHistory(s *history.Store) {
+	h.history = s
+}
+
+func (h *Handler) chart(m models.Metrics, width, height int) *chart {
+	if h.history == nil {
+		return nil
+	}
+	return newChart(h.history.Samples(m.MType, m.ID), width, height)
+}
+
+// refreshInterval reads the auto-refresh period in seconds from ?refresh=;
+// zero disables it.
+func refreshInterval(r *http.Request) int {
+	if v, err := strconv.Atoi(r.URL.Query().Get("refresh")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultRefresh
+}
+
+func (h *Handler) render(w http.ResponseWriter, status int, tmpl *template.Template, data any) {
+	// Render into a buffer so that a template error does not leave a
+	// half-written page behind a 200 status.
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout", data); err != nil {
+		h.logger.Errorf("failed to render page: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to render page")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (h *Handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.Repo.GetAll(r.Context())
+	if err != nil {
+		h.writeStorageError(w, err)
+		return
+	}
+	storage.SortMetrics(metrics)
+
+	page := indexPage{Refresh: refreshInterval(r)}
+	for _, m := range metrics {
+		row := dashboardRow{Metrics: m, Chart: h.chart(m, sparklineWidth, sparklineHeight)}
+		switch m.MType {
+		case "gauge":
+			page.Gauges = append(page.Gauges, row)
+		case "counter":
+			page.Counters = append(page.Counters, row)
+		}
+	}
+	h.render(w, http.StatusOK, indexTemplate, page)
+}
+
+func (h *Handler) MetricPage(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	name, err := wildcardName(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid metric name")
+		return
+	}
+
+	m, err := h.Repo.Get(r.Context(), metricType, name)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		h.render(w, http.StatusNotFound, metricTemplate, metricPage{
+			Metric:   models.Metrics{ID: name, MType: metricType},
+			NotFound: true,
+		})
+	case err != nil:
+		h.writeStorageError(w, err)
+	default:
+		h.render(w, http.StatusOK, metricTemplate, metricPage{
+			Metric:  m,
+			Chart:   h.chart(m, chartWidth, chartHeight),
+			Refresh: refreshInterval(r),
+		})
+	}
+}
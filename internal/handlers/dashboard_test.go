@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/history"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDashboard(t *testing.T) {
+	repo := storage.NewMemStorage()
+	require.NoError(t, repo.AddBatch(t.Context(), []models.Metrics{
+		storagetest.Gauge("Zeta", 1), storagetest.Gauge("Alpha", 2), storagetest.Counter("PollCount", 3),
+		storagetest.Gauge(`<script>alert("x")</script>`, 4), storagetest.Gauge("dc1/Alloc", 5),
+		storagetest.Gauge("a?b#c", 6),
+	}))
+	hist := history.NewStore(10)
+	for i := 0; i < 3; i++ {
+		all, err := repo.GetAll(t.Context())
+		require.NoError(t, err)
+		hist.Record(time.Unix(int64(1700000000+i), 0), all)
+	}
+	h := NewHandler(repo, zap.NewNop().Sugar())
+	h.SetHistory(hist)
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+
+	get := func(t *testing.T, target string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		assert.Equal(t, "text/html; charset=utf-8", w.Result().Header.Get("Content-Type"))
+		return w.Code, string(body)
+	}
+
+	t.Run("index", func(t *testing.T) {
+		code, body := get(t, "/")
+		require.Equal(t, http.StatusOK, code)
+
+		assert.NotContains(t, body, `<script>alert`, "metric names must be escaped")
+		assert.Contains(t, body, `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`)
+
+		gauges := body[strings.Index(body, `id="gauges"`):strings.Index(body, `id="counters"`)]
+		assert.Less(t, strings.Index(gauges, "Alpha"), strings.Index(gauges, "Zeta"), "gauges are sorted")
+		assert.NotContains(t, gauges, "PollCount", "counters are listed separately")
+		assert.Contains(t, body[strings.Index(body, `id="counters"`):], "PollCount")
+		assert.Contains(t, body, "setInterval")
+		assert.Contains(t, body, `<svg class="chart" width="120" height="20"`)
+	})
+
+	t.Run("refresh disabled", func(t *testing.T) {
+		_, body := get(t, "/?refresh=0")
+		assert.NotContains(t, body, "setInterval")
+	})
+
+	t.Run("detail page", func(t *testing.T) {
+		code, body := get(t, "/metrics/counter/PollCount")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `<td class="value">3</td>`)
+		assert.Contains(t, body, `<svg class="chart" width="600" height="200"`)
+
+		code, body = get(t, "/metrics/gauge/dc1/Alloc")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `<td class="value">5</td>`)
+
+		_, body = get(t, "/")
+		assert.Contains(t, body, `href="/metrics/gauge/dc1%2FAlloc"`)
+		code, body = get(t, "/metrics/gauge/dc1%2FAlloc")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `<td class="value">5</td>`)
+		assert.Contains(t, body, `href="/value/gauge/dc1%2FAlloc"`)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/value/gauge/dc1%2FAlloc", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "5\n", w.Body.String())
+
+		_, body = get(t, "/")
+		assert.Contains(t, body, `href="/metrics/gauge/a%3Fb%23c"`)
+		code, body = get(t, "/metrics/gauge/a%3Fb%23c")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `<td class="value">6</td>`)
+
+		code, _ = get(t, "/metrics/gauge/Missing")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
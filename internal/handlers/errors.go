@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+func statusFromError(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrUnsupportedType):
+		return http.StatusNotImplemented
+	case errors.Is(err, storage.ErrInvalidValue):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrOverloaded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg, Status: status})
+}
+
+func (h *Handler) writeStorageError(w http.ResponseWriter, err error) {
+	status := statusFromError(err)
+	if status >= http.StatusInternalServerError {
+		h.logger.Errorf("storage error: %v", err)
+	}
+	writeError(w, status, err.Error())
+}
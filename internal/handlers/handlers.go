@@ -5,17 +5,29 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/audit"
+	"github.com/kosta324/metrics.git/internal/broadcast"
+	"github.com/kosta324/metrics.git/internal/cluster"
+	"github.com/kosta324/metrics.git/internal/history"
 	"github.com/kosta324/metrics.git/internal/models"
 	"github.com/kosta324/metrics.git/internal/storage"
 	"go.uber.org/zap"
 )
 
 type Handler struct {
-	Repo   storage.Repository
-	logger *zap.SugaredLogger
+	Repo      storage.Repository
+	logger    *zap.SugaredLogger
+	cluster   *cluster.Cluster
+	audit     *audit.Publisher
+	history   *history.Store
+	broadcast *broadcast.Broadcaster
+	publisher *streamPublisher
+
+	trustedProxies []netip.Prefix
 }
 
 func NewHandler(repo storage.Repository, log *zap.SugaredLogger) *Handler {
@@ -25,14 +37,36 @@ func NewHandler(repo storage.Repository, log *zap.SugaredLogger) *Handler {
 	}
 }
 
+type pingResponse struct {
+	State          string `json:"state"`
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func breakerState(repo storage.Repository) string {
+	for repo != nil {
+		if b, ok := repo.(storage.BreakerStater); ok {
+			return b.BreakerState()
+		}
+		repo = storage.Unwrap(repo)
+	}
+	return ""
+}
+
 func (h *Handler) PingDB(w http.ResponseWriter, r *http.Request) {
-	if err := h.Repo.Ping(); err != nil {
+	resp := pingResponse{State: "ok", CircuitBreaker: breakerState(h.Repo)}
+	status := http.StatusOK
+	if err := h.Repo.Ping(r.Context()); err != nil {
 		h.logger.Errorf("database ping failed: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		resp.State = "unavailable"
+		resp.Error = err.Error()
+		resp.CircuitBreaker = breakerState(h.Repo)
+		status = http.StatusServiceUnavailable
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
@@ -40,169 +74,118 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Post("/updates/", h.UpdateMetricsBatch)
 	r.Post("/value/", h.GetMetricJSON)
 	r.Post("/update/{type}/{name}/{value}", h.UpdateMetric)
-	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Get("/value/{type}/*", h.GetMetric)
 	r.Get("/", h.ListMetrics)
+	r.Get("/metrics/{type}/*", h.MetricPage)
+	r.Get("/api/metrics", h.ListMetricsJSON)
+	r.Get("/api/stream", h.StreamMetrics)
+	r.Get("/api/aggregate", h.AggregateMetrics)
+	// The /api/v1 aliases are the paths Prometheus clients such as Grafana
+	// call.
+	for _, prefix := range []string{"/api", "/api/v1"} {
+		r.Get(prefix+"/query", h.Query)
+		r.Post(prefix+"/query", h.Query)
+		r.Get(prefix+"/query_range", h.QueryRange)
+		r.Post(prefix+"/query_range", h.QueryRange)
+	}
 	r.Get("/ping", h.PingDB)
+	r.Get("/api/cluster", h.ClusterInfo)
+	r.Get("/api/cluster/value/{type}/*", h.ClusterValue)
+	r.Post("/api/cluster/values", h.ClusterValues)
 }
 
 func (h *Handler) UpdateMetricsBatch(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	var metrics []models.Metrics
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	if err := json.Unmarshal(body, &metrics); err != nil {
-		http.Error(w, "invalid JSON array", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid JSON array")
 		return
 	}
 
 	if len(metrics) == 0 {
-		http.Error(w, "empty metrics batch", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "empty metrics batch")
 		return
 	}
 
-	if sqlRepo, ok := h.Repo.(*storage.SQLRepo); ok {
-		if err := sqlRepo.AddBatch(metrics); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		for _, m := range metrics {
-			switch m.MType {
-			case "gauge":
-				if m.Value == nil {
-					http.Error(w, "missing gauge value", http.StatusBadRequest)
-					return
-				}
-				if err := h.Repo.Add("gauge", m.ID, strconv.FormatFloat(*m.Value, 'f', -1, 64)); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			case "counter":
-				if m.Delta == nil {
-					http.Error(w, "missing counter delta", http.StatusBadRequest)
-					return
-				}
-				if err := h.Repo.Add("counter", m.ID, strconv.FormatInt(*m.Delta, 10)); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			default:
-				http.Error(w, "unknown metric type", http.StatusNotImplemented)
-				return
-			}
-		}
+	if err := h.Repo.AddBatch(r.Context(), metrics); err != nil {
+		h.writeStorageError(w, err)
+		return
 	}
+	h.auditUpdate(r, metrics...)
+	h.publishUpdate(metrics...)
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
 func (h *Handler) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 	var m models.Metrics
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	err = json.Unmarshal(body, &m)
 	if err != nil || m.ID == "" || m.MType == "" {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid JSON")
 		return
 	}
 
-	switch m.MType {
-	case "gauge":
-		if m.Value == nil {
-			http.Error(w, "missing gauge value", http.StatusBadRequest)
-			return
-		}
-		err = h.Repo.Add("gauge", m.ID, strconv.FormatFloat(*m.Value, 'f', -1, 64))
-	case "counter":
-		if m.Delta == nil {
-			http.Error(w, "missing counter delta", http.StatusBadRequest)
-			return
-		}
-		err = h.Repo.Add("counter", m.ID, strconv.FormatInt(*m.Delta, 10))
-	default:
-		http.Error(w, "unknown metric type", http.StatusNotImplemented)
+	if err := h.Repo.Add(r.Context(), m); err != nil {
+		h.writeStorageError(w, err)
 		return
 	}
+	h.auditUpdate(r, m)
+	h.publishUpdate(m)
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// A queued write is not applied yet, so there is no stored value to
+	// answer with.
+	if storage.DefersWrites(h.Repo) {
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
 
-	val, getErr := h.Repo.Get(m.MType, m.ID)
-	if getErr != nil {
-		http.Error(w, getErr.Error(), http.StatusNotFound)
+	stored, err := h.Repo.Get(r.Context(), m.MType, m.ID)
+	if err != nil {
+		h.writeStorageError(w, err)
 		return
 	}
 
-	switch m.MType {
-	case "gauge":
-		v, err := strconv.ParseFloat(val, 64)
-		if err == nil {
-			m.Value = &v
-		}
-	case "counter":
-		v, err := strconv.ParseInt(val, 10, 64)
-		if err == nil {
-			m.Delta = &v
-		}
-	}
-
-	json.NewEncoder(w).Encode(m)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
 }
 
 func (h *Handler) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 	var m models.Metrics
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	err = json.Unmarshal(body, &m)
 	if err != nil || m.ID == "" || m.MType == "" {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	val, getErr := h.Repo.Get(m.MType, m.ID)
-	if getErr != nil {
-		http.Error(w, getErr.Error(), http.StatusNotFound)
+		writeError(w, http.StatusBadRequest, "invalid JSON")
 		return
 	}
 
-	switch m.MType {
-	case "gauge":
-		v, err := strconv.ParseFloat(val, 64)
-		if err == nil {
-			m.Value = &v
-		}
-	case "counter":
-		v, err := strconv.ParseInt(val, 10, 64)
-		if err == nil {
-			m.Delta = &v
-		}
-	default:
-		http.Error(w, "unknown metric type", http.StatusNotImplemented)
+	stored, err := h.Repo.Get(r.Context(), m.MType, m.ID)
+	if err != nil {
+		h.writeStorageError(w, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(m)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
 }
 
 func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
@@ -211,16 +194,22 @@ func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	value := chi.URLParam(r, "value")
 
 	if name == "" {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		http.Error(w, "metric name required", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "metric name required")
+		return
+	}
+
+	m, err := parseMetric(metricType, name, value)
+	if err != nil {
+		h.writeStorageError(w, err)
 		return
 	}
 
-	if err := h.Repo.Add(metricType, name, value); err != nil {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := h.Repo.Add(r.Context(), m); err != nil {
+		h.writeStorageError(w, err)
 		return
 	}
+	h.auditUpdate(r, m)
+	h.publishUpdate(m)
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "OK")
@@ -228,31 +217,36 @@ func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) GetMetric(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
-	name := chi.URLParam(r, "name")
-
-	value, err := h.Repo.Get(metricType, name)
+	name, err := wildcardName(r)
 	if err != nil {
-		http.Error(w, "metric not found", http.StatusNotFound)
+		writeError(w, http.StatusBadRequest, "invalid metric name")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, value)
+	if r.URL.Query().Has("wait") {
+		h.watchMetric(w, r, metricType, name)
+		return
+	}
+	h.writeValue(w, r, metricType, name)
 }
 
-func (h *Handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	metrics := h.Repo.GetAll()
-
-	w.Write([]byte("<html><body><h1>Metrics</h1><ul>"))
-	keys := make([]string, 0, len(metrics))
-	for k := range metrics {
-		keys = append(keys, k)
-	}
-	for _, k := range keys {
-		v := metrics[k]
-		w.Write([]byte("<li><b>" + k + "</b>: " + v + "</li>"))
+func parseMetric(metricType, name, value string) (models.Metrics, error) {
+	m := models.Metrics{ID: name, MType: metricType}
+	switch metricType {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return models.Metrics{}, fmt.Errorf("%w: %s", storage.ErrInvalidValue, value)
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return models.Metrics{}, fmt.Errorf("%w: %s", storage.ErrInvalidValue, value)
+		}
+		m.Delta = &d
+	default:
+		return models.Metrics{}, fmt.Errorf("%w: %s", storage.ErrUnsupportedType, metricType)
 	}
-	w.Write([]byte("</ul></body></html>"))
+	return m, nil
 }
@@ -2,15 +2,23 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/audit"
+	"github.com/kosta324/metrics.git/internal/broadcast"
+	"github.com/kosta324/metrics.git/internal/ingest"
 	"github.com/kosta324/metrics.git/internal/models"
 	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -115,8 +123,8 @@ func TestGetMetricJSON(t *testing.T) {
 	}
 
 	repo := storage.NewMemStorage()
-	_ = repo.Add("gauge", "GaugeTwoDecimals", "603057.87")
-	_ = repo.Add("counter", "PollCount", "7")
+	_ = repo.Add(context.Background(), storagetest.Gauge("GaugeTwoDecimals", 603057.87))
+	_ = repo.Add(context.Background(), storagetest.Counter("PollCount", 7))
 	logger, err := zap.NewDevelopment()
 	require.NoError(t, err, "failed to create logger")
 	defer logger.Sync()
@@ -196,8 +204,8 @@ func TestUpdateMetric(t *testing.T) {
 			method: http.MethodPost,
 			url:    "/update/invalid/Metric/123",
 			want: want{
-				code:        400,
-				contentType: "text/plain; charset=utf-8",
+				code:        501,
+				contentType: "application/json",
 			},
 		},
 		{
@@ -206,7 +214,7 @@ func TestUpdateMetric(t *testing.T) {
 			url:    "/update/gauge/SomeMetric/abc",
 			want: want{
 				code:        400,
-				contentType: "text/plain; charset=utf-8",
+				contentType: "application/json",
 			},
 		},
 		{
@@ -215,7 +223,7 @@ func TestUpdateMetric(t *testing.T) {
 			url:    "/update/counter/SomeMetric/NaN",
 			want: want{
 				code:        400,
-				contentType: "text/plain; charset=utf-8",
+				contentType: "application/json",
 			},
 		},
 		{
@@ -224,7 +232,7 @@ func TestUpdateMetric(t *testing.T) {
 			url:    "/update/counter//123",
 			want: want{
 				code:        400,
-				contentType: "text/plain; charset=utf-8",
+				contentType: "application/json",
 			},
 		},
 	}
@@ -259,9 +267,9 @@ func TestUpdateMetric(t *testing.T) {
 
 func setupRouterWithTestData(t *testing.T) http.Handler {
 	repo := storage.NewMemStorage()
-	_ = repo.Add("gauge", "GaugeTwoDecimals", "603057.87")
-	_ = repo.Add("gauge", "GaugeThreeDecimals", "550386.837")
-	_ = repo.Add("counter", "PollCount", "7")
+	_ = repo.Add(context.Background(), storagetest.Gauge("GaugeTwoDecimals", 603057.87))
+	_ = repo.Add(context.Background(), storagetest.Gauge("GaugeThreeDecimals", 550386.837))
+	_ = repo.Add(context.Background(), storagetest.Counter("PollCount", 7))
 
 	logger, err := zap.NewDevelopment()
 	require.NoError(t, err, "failed to create logger")
@@ -322,7 +330,7 @@ func TestGetMetrics(t *testing.T) {
 			url:  "/",
 			want: want{
 				code:     http.StatusOK,
-				contains: "<li><b>GaugeTwoDecimals</b>: 603057.87</li>",
+				contains: `<a href="/metrics/gauge/GaugeTwoDecimals">GaugeTwoDecimals</a></td><td class="value">603057.87</td>`,
 			},
 		},
 	}
@@ -351,3 +359,269 @@ func TestGetMetrics(t *testing.T) {
 		})
 	}
 }
+
+type unavailableRepo struct {
+	storage.Repository
+}
+
+func (unavailableRepo) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	return models.Metrics{}, storage.ErrUnavailable
+}
+
+func TestStorageErrorMapping(t *testing.T) {
+	tests := []struct {
+		name string
+		repo storage.Repository
+		body string
+		code int
+	}{
+		{
+			name: "not found",
+			repo: storage.NewMemStorage(),
+			body: `{"id":"Unknown","type":"gauge"}`,
+			code: http.StatusNotFound,
+		},
+		{
+			name: "unsupported type",
+			repo: storage.NewMemStorage(),
+			body: `{"id":"Unknown","type":"histogram"}`,
+			code: http.StatusNotImplemented,
+		},
+		{
+			name: "storage unavailable",
+			repo: unavailableRepo{},
+			body: `{"id":"Alloc","type":"gauge"}`,
+			code: http.StatusServiceUnavailable,
+		},
+	}
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err, "failed to create logger")
+	defer logger.Sync()
+	log := logger.Sugar()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			NewHandler(tt.repo, log).RegisterRoutes(r)
+
+			req := httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+			var got errorResponse
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+			assert.Equal(t, tt.code, got.Status)
+			assert.NotEmpty(t, got.Error)
+		})
+	}
+}
+
+type fullQueueRepo struct {
+	storage.Repository
+}
+
+func (fullQueueRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	return fmt.Errorf("%w: queue is full", storage.ErrOverloaded)
+}
+
+func TestUpdateMetricJSONQueued(t *testing.T) {
+	mem := storage.NewMemStorage()
+	q, err := ingest.NewQueue(mem, ingest.Config{QueueSize: 10, FlushInterval: time.Hour, FlushBatch: 1000})
+	require.NoError(t, err)
+	r := chi.NewRouter()
+	NewHandler(q, zap.NewNop().Sugar()).RegisterRoutes(r)
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBufferString(`{"id":"PollCount","type":"counter","delta":2}`))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code, "a queued write is accepted, not looked up")
+		assert.Empty(t, w.Body.String())
+	}
+
+	require.NoError(t, q.Close(context.Background()))
+	m, err := mem.Get(context.Background(), "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *m.Delta)
+}
+
+func TestUpdateMetricsBatchBackpressure(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err, "failed to create logger")
+	defer logger.Sync()
+
+	r := chi.NewRouter()
+	NewHandler(fullQueueRepo{}, logger.Sugar()).RegisterRoutes(r)
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(`[{"id":"PollCount","type":"counter","delta":1}]`))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+type breakerRepo struct {
+	*storage.MemStorage
+	state string
+}
+
+func (r breakerRepo) BreakerState() string {
+	return r.state
+}
+
+func (r breakerRepo) Ping(ctx context.Context) error {
+	if r.state == "open" {
+		return storage.ErrUnavailable
+	}
+	return nil
+}
+
+func TestPingDB(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		code  int
+	}{
+		{name: "closed breaker", state: "closed", code: http.StatusOK},
+		{name: "open breaker", state: "open", code: http.StatusServiceUnavailable},
+	}
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err, "failed to create logger")
+	defer logger.Sync()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := storage.NewCachedRepo(context.Background(),
+				breakerRepo{MemStorage: storage.NewMemStorage(), state: tt.state}, storage.CacheConfig{})
+			require.NoError(t, err)
+
+			r := chi.NewRouter()
+			NewHandler(repo, logger.Sugar()).RegisterRoutes(r)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+
+			var got pingResponse
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+			assert.Equal(t, tt.state, got.CircuitBreaker)
+		})
+	}
+}
+
+type auditRecorder struct {
+	events chan audit.Event
+}
+
+func (r auditRecorder) Notify(ctx context.Context, e audit.Event) error {
+	r.events <- e
+	return nil
+}
+
+func TestAuditUpdates(t *testing.T) {
+	rec := auditRecorder{events: make(chan audit.Event, 10)}
+	pub := audit.NewPublisher(10, nil)
+	pub.Subscribe(rec)
+
+	h := NewHandler(storage.NewMemStorage(), zap.NewNop().Sugar())
+	h.SetAudit(pub)
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+
+	requests := []struct {
+		req  *http.Request
+		want []string
+	}{
+		{httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil), []string{"PollCount"}},
+		{httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1}`)), []string{"Alloc"}},
+		{httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"A","type":"gauge","value":1},{"id":"B","type":"counter","delta":2}]`)), []string{"A", "B"}},
+		{httptest.NewRequest(http.MethodPost, "/update/gauge/Alloc/bad", nil), nil},
+	}
+	for _, tt := range requests {
+		tt.req.RemoteAddr = "10.0.0.7:51234"
+		r.ServeHTTP(httptest.NewRecorder(), tt.req)
+	}
+	require.NoError(t, pub.Close(context.Background()))
+	close(rec.events)
+
+	var got []audit.Event
+	for e := range rec.events {
+		got = append(got, e)
+	}
+	require.Len(t, got, 3, "rejected updates are not audited")
+	for i, e := range got {
+		assert.Equal(t, requests[i].want, e.Metrics)
+		assert.Equal(t, "10.0.0.7", e.IPAddress)
+		assert.NotZero(t, e.TS)
+	}
+}
+
+func TestNotifyUpdate(t *testing.T) {
+	rec := auditRecorder{events: make(chan audit.Event, 10)}
+	pub := audit.NewPublisher(10, nil)
+	pub.Subscribe(rec)
+	b := broadcast.New(10)
+	defer b.Close()
+
+	repo := storage.NewMemStorage()
+	h := NewHandler(repo, zap.NewNop().Sugar())
+	h.SetAudit(pub)
+	h.SetBroadcaster(b)
+	sub := b.Subscribe(nil)
+
+	m := storagetest.Counter("PollCount", 3)
+	require.NoError(t, repo.Add(context.Background(), m))
+	h.NotifyUpdate("10.0.0.7", m)
+
+	require.NoError(t, pub.Close(context.Background()))
+	e := <-rec.events
+	assert.Equal(t, []string{"PollCount"}, e.Metrics)
+	assert.Equal(t, "10.0.0.7", e.IPAddress)
+	got := <-sub.C
+	assert.Equal(t, int64(3), *got.Delta)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.1, 192.168.0.0/16")
+	require.NoError(t, err)
+	h := NewHandler(storage.NewMemStorage(), zap.NewNop().Sugar())
+	h.SetTrustedProxies(proxies)
+
+	tests := []struct {
+		name   string
+		remote string
+		realIP string
+		want   string
+	}{
+		{name: "direct", remote: "10.0.0.7:51234", want: "10.0.0.7"},
+		{name: "untrusted peer", remote: "10.0.0.7:51234", realIP: "1.2.3.4", want: "10.0.0.7"},
+		{name: "trusted address", remote: "10.0.0.1:51234", realIP: "1.2.3.4", want: "1.2.3.4"},
+		{name: "trusted prefix", remote: "192.168.3.4:51234", realIP: "1.2.3.4", want: "1.2.3.4"},
+		{name: "trusted proxy without header", remote: "10.0.0.1:51234", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/update/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			assert.Equal(t, tt.want, h.clientIP(req))
+		})
+	}
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+}
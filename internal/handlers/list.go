@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+const (
+	defaultPageSize = 1000
+	maxPageSize     = 10000
+)
+
+func encodeCursor(m models.Metrics) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(m.MType + ":" + m.ID))
+}
+
+func decodeCursor(cursor string) (id, mtype string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", errors.New("invalid cursor")
+	}
+	mtype, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return "", "", errors.New("invalid cursor")
+	}
+	return id, mtype, nil
+}
+
+func parseListOptions(q url.Values) (storage.ListOptions, error) {
+	opts := storage.ListOptions{
+		Type:   q.Get("type"),
+		Prefix: q.Get("prefix"),
+		Limit:  defaultPageSize,
+	}
+	if opts.Type != "" && opts.Type != "gauge" && opts.Type != "counter" {
+		return opts, errors.New("type must be gauge or counter")
+	}
+	if expr := q.Get("regex"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return opts, errors.New("invalid regex: " + err.Error())
+		}
+		opts.Regex = re
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return opts, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		opts.Limit = limit
+	}
+	if cursor := q.Get("cursor"); cursor != "" {
+		id, mtype, err := decodeCursor(cursor)
+		if err != nil {
+			return opts, err
+		}
+		opts.AfterID, opts.AfterType = id, mtype
+	}
+	return opts, nil
+}
+
+// ListMetricsJSON returns a page of metrics ordered by ID and type. The page
+// is fetched with one extra item to tell whether another page follows.
+func (h *Handler) ListMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := opts.Limit
+	opts.Limit++
+	metrics, err := h.Repo.List(r.Context(), opts)
+	if err != nil {
+		h.writeStorageError(w, err)
+		return
+	}
+	if metrics == nil {
+		metrics = []models.Metrics{}
+	}
+
+	next := ""
+	if len(metrics) > limit {
+		metrics = metrics[:limit]
+		next = encodeCursor(metrics[limit-1])
+	}
+
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(metrics); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if next != "" {
+		w.Header().Set(models.NextCursorHeader, next)
+		q := r.URL.Query()
+		q.Set("cursor", next)
+		w.Header().Set("Link", `<`+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestListMetricsJSON(t *testing.T) {
+	repo := storage.NewMemStorage()
+	require.NoError(t, repo.AddBatch(t.Context(), []models.Metrics{
+		storagetest.Gauge("Alloc", 1), storagetest.Gauge("HeapAlloc", 2), storagetest.Gauge("HeapIdle", 3),
+		storagetest.Counter("PollCount", 4), storagetest.Counter("HeapCount", 5),
+	}))
+	r := chi.NewRouter()
+	NewHandler(repo, zap.NewNop().Sugar()).RegisterRoutes(r)
+
+	list := func(t *testing.T, target string, header http.Header) (*http.Response, []string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		res := w.Result()
+		t.Cleanup(func() { res.Body.Close() })
+
+		var names []string
+		if res.StatusCode == http.StatusOK {
+			var metrics []models.Metrics
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&metrics))
+			for _, m := range metrics {
+				names = append(names, m.MType+":"+m.ID)
+			}
+		}
+		return res, names
+	}
+
+	t.Run("filters", func(t *testing.T) {
+		tests := []struct {
+			query string
+			want  []string
+		}{
+			{"", []string{"gauge:Alloc", "gauge:HeapAlloc", "counter:HeapCount", "gauge:HeapIdle", "counter:PollCount"}},
+			{"?type=counter", []string{"counter:HeapCount", "counter:PollCount"}},
+			{"?prefix=Heap&type=gauge", []string{"gauge:HeapAlloc", "gauge:HeapIdle"}},
+			{"?regex=Alloc$", []string{"gauge:Alloc", "gauge:HeapAlloc"}},
+		}
+		for _, tt := range tests {
+			res, names := list(t, "/api/metrics"+tt.query, nil)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			assert.Equal(t, tt.want, names, tt.query)
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		var all []string
+		target := "/api/metrics?limit=2"
+		for pages := 0; target != ""; pages++ {
+			require.Less(t, pages, 5)
+			res, names := list(t, target, nil)
+			all = append(all, names...)
+			target = ""
+			if next := res.Header.Get(models.NextCursorHeader); next != "" {
+				target = "/api/metrics?limit=2&cursor=" + next
+			}
+		}
+		assert.Equal(t, []string{"gauge:Alloc", "gauge:HeapAlloc", "counter:HeapCount", "gauge:HeapIdle", "counter:PollCount"}, all)
+	})
+
+	t.Run("etag", func(t *testing.T) {
+		res, _ := list(t, "/api/metrics?type=gauge", nil)
+		etag := res.Header.Get("ETag")
+		require.NotEmpty(t, etag)
+
+		res, _ = list(t, "/api/metrics?type=gauge", http.Header{"If-None-Match": {etag}})
+		assert.Equal(t, http.StatusNotModified, res.StatusCode)
+
+		require.NoError(t, repo.Add(t.Context(), storagetest.Gauge("Alloc", 10)))
+		res, _ = list(t, "/api/metrics?type=gauge", http.Header{"If-None-Match": {etag}})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotEqual(t, etag, res.Header.Get("ETag"))
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"?type=histogram", "?regex=(", "?limit=0", "?limit=x", "?cursor=!!"} {
+			res, _ := list(t, "/api/metrics"+query, nil)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, query)
+		}
+	})
+}
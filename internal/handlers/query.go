@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/query"
+)
+
+// The query endpoints answer in the Prometheus HTTP API format so that
+// Prometheus clients can read from them.
+type queryResponse struct {
+	Status    string     `json:"status"`
+	Data      *queryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType query.ValueType `json:"resultType"`
+	Result     any             `json:"result"`
+}
+
+type vectorSample struct {
+	Metric query.Labels `json:"metric"`
+	Value  []any        `json:"value"`
+}
+
+type matrixSeries struct {
+	Metric query.Labels `json:"metric"`
+	Values [][]any      `json:"values"`
+}
+
+func writeQueryError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(queryResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+func writeQueryResult(w http.ResponseWriter, v query.Value) {
+	data := &queryData{ResultType: v.Type()}
+	switch v := v.(type) {
+	case query.Scalar:
+		data.Result = point(v.T, v.V)
+	case query.Vector:
+		result := make([]vectorSample, len(v))
+		for i, s := range v {
+			result[i] = vectorSample{Metric: nonNil(s.Labels), Value: point(s.T, s.V)}
+		}
+		data.Result = result
+	case query.Matrix:
+		data.Result = matrixResult(v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queryResponse{Status: "success", Data: data})
+}
+
+func matrixResult(m query.Matrix) []matrixSeries {
+	result := make([]matrixSeries, len(m))
+	for i, s := range m {
+		values := make([][]any, len(s.Points))
+		for j, p := range s.Points {
+			values[j] = point(p.TS, p.Value)
+		}
+		result[i] = matrixSeries{Metric: nonNil(s.Labels), Values: values}
+	}
+	return result
+}
+
+// point encodes a sample as [unix seconds, "value"]; values are strings so
+// that NaN and infinities survive JSON.
+func point(ts time.Time, v float64) []any {
+	return []any{float64(ts.UnixMilli()) / 1000, strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+func nonNil(l query.Labels) query.Labels {
+	if l == nil {
+		return query.Labels{}
+	}
+	return l
+}
+
+// parseQueryTime accepts Unix seconds with an optional fraction or RFC 3339.
+func parseQueryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e3))*int64(time.Millisecond)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("cannot parse " + strconv.Quote(s) + " as a timestamp")
+}
+
+// parseStep accepts seconds or a duration such as 15s.
+func parseStep(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if d, err := query.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, errors.New("cannot parse " + strconv.Quote(s) + " as a step")
+}
+
+func (h *Handler) queryEngine(w http.ResponseWriter, r *http.Request) (*query.Engine, query.Expr, bool) {
+	if h.history == nil {
+		writeQueryError(w, http.StatusServiceUnavailable, "unavailable", errors.New("metrics history is disabled"))
+		return nil, nil, false
+	}
+	expr, err := query.Parse(r.FormValue("query"))
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_data", err)
+		return nil, nil, false
+	}
+	return query.NewEngine(h.history), expr, true
+}
+
+// Query evaluates ?query= at ?time=, which defaults to now.
+func (h *Handler) Query(w http.ResponseWriter, r *http.Request) {
+	engine, expr, ok := h.queryEngine(w, r)
+	if !ok {
+		return
+	}
+	ts, err := parseQueryTime(r.FormValue("time"), time.Now())
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	v, err := engine.Instant(expr, ts)
+	if err != nil {
+		writeQueryError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	writeQueryResult(w, v)
+}
+
+// QueryRange evaluates ?query= at every ?step= from ?start= to ?end=.
+func (h *Handler) QueryRange(w http.ResponseWriter, r *http.Request) {
+	engine, expr, ok := h.queryEngine(w, r)
+	if !ok {
+		return
+	}
+	start, err := parseQueryTime(r.FormValue("start"), time.Time{})
+	if err == nil && start.IsZero() {
+		err = errors.New("start is required")
+	}
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	end, err := parseQueryTime(r.FormValue("end"), time.Now())
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	step, err := parseStep(r.FormValue("step"))
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	m, err := engine.Range(expr, start, end, step)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	writeQueryResult(w, m)
+}
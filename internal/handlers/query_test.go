@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/history"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestQuery(t *testing.T) {
+	hist := history.NewStore(10)
+	for i := 0; i < 3; i++ {
+		hist.Record(time.Unix(int64(1700000000+10*i), 0), []models.Metrics{
+			storagetest.Gauge("dc1/HeapAlloc", float64(100+i)),
+			storagetest.Gauge("dc2/HeapAlloc", 200),
+			storagetest.Counter("PollCount", int64(5*i)),
+		})
+	}
+	h := NewHandler(storage.NewMemStorage(), zap.NewNop().Sugar())
+	h.SetHistory(hist)
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		want   string
+	}{
+		{
+			name:   "vector",
+			req:    httptest.NewRequest(http.MethodGet, "/api/query?time=1700000020&query="+url.QueryEscape(`HeapAlloc{source="dc1"}`), nil),
+			status: http.StatusOK,
+			want:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"HeapAlloc","source":"dc1","type":"gauge"},"value":[1700000020,"102"]}]}}`,
+		},
+		{
+			name:   "aggregation",
+			req:    httptest.NewRequest(http.MethodGet, "/api/v1/query?time=2023-11-14T22:13:40Z&query="+url.QueryEscape(`sum(HeapAlloc)`), nil),
+			status: http.StatusOK,
+			want:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000020,"302"]}]}}`,
+		},
+		{
+			name:   "scalar",
+			req:    httptest.NewRequest(http.MethodGet, "/api/query?time=1700000000.5&query=1/0", nil),
+			status: http.StatusOK,
+			want:   `{"status":"success","data":{"resultType":"scalar","result":[1700000000.5,"+Inf"]}}`,
+		},
+		{
+			name:   "range over form body",
+			req:    formRequest("/api/query_range", url.Values{"query": {"rate(PollCount[30s])"}, "start": {"1700000010"}, "end": {"1700000020"}, "step": {"10s"}}),
+			status: http.StatusOK,
+			want:   `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"type":"counter"},"values":[[1700000010,"0.5"],[1700000020,"0.5"]]}]}}`,
+		},
+		{
+			name:   "parse error",
+			req:    httptest.NewRequest(http.MethodGet, "/api/query?query="+url.QueryEscape("sum("), nil),
+			status: http.StatusBadRequest,
+			want:   `{"status":"error","errorType":"bad_data","error":"parse error: unexpected end of input"}`,
+		},
+		{
+			name:   "bad time",
+			req:    httptest.NewRequest(http.MethodGet, "/api/query?query=PollCount&time=yesterday", nil),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "range needs start",
+			req:    httptest.NewRequest(http.MethodGet, "/api/query_range?query=PollCount&step=1", nil),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "range rejects range vectors",
+			req:    httptest.NewRequest(http.MethodGet, "/api/query_range?query="+url.QueryEscape("PollCount[1m]")+"&start=1700000000&end=1700000020&step=10", nil),
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	disabled := chi.NewRouter()
+	NewHandler(storage.NewMemStorage(), zap.NewNop().Sugar()).RegisterRoutes(disabled)
+	w := httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/query?query=PollCount", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func formRequest(target string, form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
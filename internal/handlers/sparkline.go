@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/history"
+)
+
+// chart holds everything a template needs to draw samples as an SVG
+// polyline; coordinates are precomputed so that templates stay free of math.
+type chart struct {
+	Width  int
+	Height int
+	Points string
+	Min    string
+	Max    string
+	From   string
+	To     string
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+func newChart(samples []history.Sample, width, height int) *chart {
+	if len(samples) < 2 {
+		return nil
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range samples {
+		lo = math.Min(lo, s.Value)
+		hi = math.Max(hi, s.Value)
+	}
+	first, last := samples[0].TS, samples[len(samples)-1].TS
+	span := last.Sub(first).Seconds()
+
+	// Keep one pixel of padding so that the stroke is not clipped.
+	const pad = 1.0
+	w, h := float64(width)-2*pad, float64(height)-2*pad
+
+	var points strings.Builder
+	for i, s := range samples {
+		x := pad + w*float64(i)/float64(len(samples)-1)
+		if span > 0 {
+			x = pad + w*s.TS.Sub(first).Seconds()/span
+		}
+		y := pad + h/2
+		if hi > lo {
+			y = pad + h*(hi-s.Value)/(hi-lo)
+		}
+		if i > 0 {
+			points.WriteByte(' ')
+		}
+		points.WriteString(strconv.FormatFloat(x, 'f', 1, 64))
+		points.WriteByte(',')
+		points.WriteString(strconv.FormatFloat(y, 'f', 1, 64))
+	}
+
+	return &chart{
+		Width:  width,
+		Height: height,
+		Points: points.String(),
+		Min:    formatValue(lo),
+		Max:    formatValue(hi),
+		From:   first.Format(time.TimeOnly),
+		To:     last.Format(time.TimeOnly),
+	}
+}
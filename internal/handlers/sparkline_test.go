@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewChart(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	samples := []history.Sample{
+		{TS: start, Value: 10},
+		{TS: start.Add(time.Second), Value: 30},
+		{TS: start.Add(4 * time.Second), Value: 20},
+	}
+
+	c := newChart(samples, 102, 22)
+	require.NotNil(t, c)
+	assert.Equal(t, "1.0,21.0 26.0,1.0 101.0,11.0", c.Points, "x follows timestamps, y is inverted")
+	assert.Equal(t, "10", c.Min)
+	assert.Equal(t, "30", c.Max)
+	assert.Equal(t, "10:00:00", c.From)
+	assert.Equal(t, "10:00:04", c.To)
+
+	flat := newChart([]history.Sample{{TS: start, Value: 5}, {TS: start.Add(time.Second), Value: 5}}, 102, 22)
+	require.NotNil(t, flat)
+	assert.Equal(t, "1.0,11.0 101.0,11.0", flat.Points)
+
+	assert.Nil(t, newChart(samples[:1], 102, 22), "a single sample is not a trend")
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/broadcast"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+// streamHeartbeat keeps idle streams alive through proxies.
+var streamHeartbeat = 15 * time.Second
+
+const streamLookupTimeout = 5 * time.Second
+
+type metricKey struct {
+	mtype string
+	id    string
+}
+
+// streamPublisher looks up the stored values of updated metrics and
+// publishes them to stream subscribers. The lookups run in the background so
+// that a subscriber never slows ingestion down, and updates of the same
+// metric made in the meantime are coalesced into a single lookup.
+type streamPublisher struct {
+	h    *Handler
+	wake chan struct{}
+
+	mu      sync.Mutex
+	pending map[metricKey]struct{}
+}
+
+// SetBroadcaster enables /api/stream. Background lookups stop when b is
+// closed.
+func (h *Handler) SetBroadcaster(b *broadcast.Broadcaster) {
+	h.broadcast = b
+	h.publisher = &streamPublisher{h: h, wake: make(chan struct{}, 1), pending: make(map[metricKey]struct{})}
+	go h.publisher.run()
+}
+
+// publishUpdate queues updated metrics for publishing; it does nothing while
+// nobody is listening.
+func (h *Handler) publishUpdate(metrics ...models.Metrics) {
+	if h.broadcast == nil || !h.broadcast.HasSubscribers() {
+		return
+	}
+	p := h.publisher
+	p.mu.Lock()
+	for _, m := range metrics {
+		p.pending[metricKey{m.MType, m.ID}] = struct{}{}
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *streamPublisher) run() {
+	for {
+		select {
+		case <-p.h.broadcast.Done():
+			return
+		case <-p.wake:
+		}
+
+		p.mu.Lock()
+		keys := p.pending
+		p.pending = make(map[metricKey]struct{})
+		p.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), streamLookupTimeout)
+		stored := make([]models.Metrics, 0, len(keys))
+		for k := range keys {
+			m, err := p.h.Repo.Get(ctx, k.mtype, k.id)
+			if err != nil {
+				p.h.logger.Warnf("failed to read %s %s for stream: %v", k.mtype, k.id, err)
+				continue
+			}
+			stored = append(stored, m)
+		}
+		cancel()
+		storage.SortMetrics(stored)
+		p.h.broadcast.Publish(stored...)
+	}
+}
+
+func streamFilter(names []string, metricType string) func(m models.Metrics) bool {
+	if len(names) == 0 && metricType == "" {
+		return nil
+	}
+	return func(m models.Metrics) bool {
+		if metricType != "" && m.MType != metricType {
+			return false
+		}
+		return len(names) == 0 || slices.Contains(names, m.ID)
+	}
+}
+
+// StreamMetrics streams metric updates as Server-Sent Events. The stream ends
+// when the client disconnects or falls too far behind.
+func (h *Handler) StreamMetrics(w http.ResponseWriter, r *http.Request) {
+	if h.broadcast == nil {
+		writeError(w, http.StatusNotFound, "streaming is disabled")
+		return
+	}
+	q := r.URL.Query()
+	metricType := q.Get("type")
+	if metricType != "" && metricType != "gauge" && metricType != "counter" {
+		writeError(w, http.StatusBadRequest, "type must be gauge or counter")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	sub := h.broadcast.Subscribe(streamFilter(q["name"], metricType))
+	defer h.broadcast.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		h.logger.Errorf("stream flushing is not supported: %v", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+		case m, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				h.logger.Errorf("failed to encode stream event: %v", err)
+				continue
+			}
+			if _, err := w.Write([]byte("event: metric\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/broadcast"
+	"github.com/kosta324/metrics.git/internal/logger"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/kosta324/metrics.git/internal/zipper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStreamMetrics(t *testing.T) {
+	old := streamHeartbeat
+	streamHeartbeat = 50 * time.Millisecond
+	defer func() { streamHeartbeat = old }()
+
+	log := zap.NewNop().Sugar()
+	b := broadcast.New(10)
+	h := NewHandler(storage.NewMemStorage(), log)
+	h.SetBroadcaster(b)
+	r := chi.NewRouter()
+	r.Use(zipper.GzipMiddleware)
+	r.Use(logger.WithLogging(log))
+	h.RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/stream?type=counter&name=PollCount", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	require.Eventually(t, b.HasSubscribers, time.Second, 10*time.Millisecond)
+
+	post := func(path string) {
+		resp, err := srv.Client().Post(srv.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	heartbeat := false
+	sc := bufio.NewScanner(res.Body)
+	nextEvent := func() string {
+		for sc.Scan() {
+			line := sc.Text()
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				return data
+			}
+			heartbeat = heartbeat || line == ": heartbeat"
+		}
+		require.NoError(t, sc.Err())
+		return ""
+	}
+
+	post("/update/gauge/PollCount/1")
+	post("/update/counter/Other/1")
+	post("/update/counter/PollCount/2")
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":2}`, nextEvent(), "filtered out updates are skipped")
+	post("/update/counter/PollCount/3")
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":5}`, nextEvent(), "events carry the stored value")
+	resp, err := srv.Client().Post(srv.URL+"/update/", "application/json",
+		strings.NewReader(`{"id":"PollCount","type":"counter","delta":4}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":9}`, nextEvent(), "JSON updates are published too")
+
+	for !heartbeat && sc.Scan() {
+		heartbeat = sc.Text() == ": heartbeat"
+	}
+	assert.True(t, heartbeat)
+
+	b.Close()
+	for sc.Scan() {
+	}
+	require.NoError(t, sc.Err(), "closing the broadcaster ends the stream")
+}
+
+// Go's client asks for gzip but not for text/event-stream; the stream must
+// still be flushed event by event rather than buffered for compression.
+func TestStreamMetricsGzipClient(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	b := broadcast.New(10)
+	h := NewHandler(storage.NewMemStorage(), log)
+	h.SetBroadcaster(b)
+	r := chi.NewRouter()
+	r.Use(zipper.GzipMiddleware)
+	r.Use(logger.WithLogging(log))
+	h.RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/stream", nil)
+	require.NoError(t, err)
+	res, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	require.Eventually(t, b.HasSubscribers, time.Second, 10*time.Millisecond)
+
+	b.Publish(storagetest.Gauge("Alloc", 1))
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+			assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1}`, data)
+			return
+		}
+	}
+	t.Fatalf("no event received: %v", sc.Err())
+}
+
+type slowGetRepo struct {
+	*storage.MemStorage
+	release chan struct{}
+}
+
+func (r slowGetRepo) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	<-r.release
+	return r.MemStorage.Get(ctx, metricType, name)
+}
+
+func TestPublishUpdateDoesNotBlockIngestion(t *testing.T) {
+	repo := slowGetRepo{MemStorage: storage.NewMemStorage(), release: make(chan struct{})}
+	b := broadcast.New(10)
+	defer b.Close()
+	h := NewHandler(repo, zap.NewNop().Sugar())
+	h.SetBroadcaster(b)
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+	sub := b.Subscribe(nil)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	close(repo.release)
+	m := <-sub.C
+	assert.Equal(t, "PollCount", m.ID)
+	assert.Equal(t, int64(3), *m.Delta)
+}
+
+func TestStreamMetricsBadType(t *testing.T) {
+	h := NewHandler(storage.NewMemStorage(), zap.NewNop().Sugar())
+	h.SetBroadcaster(broadcast.New(10))
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/stream?type=histogram", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
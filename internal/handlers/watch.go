@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+const (
+	// MetricVersionHeader carries the version of the metric returned by
+	// GET /value/{type}/{name}; pass it back as ?since= to wait for a change.
+	MetricVersionHeader = "X-Metric-Version"
+	maxWatchWait        = 5 * time.Minute
+)
+
+// watchPoll bounds how long a watcher can miss a change that was not
+// broadcast, e.g. one written by another instance or flushed from a queue.
+var watchPoll = time.Second
+
+// versioner finds the outermost repository that tracks versions. Wrappers
+// without versions pass reads through, so it serves the same values as repo.
+func versioner(repo storage.Repository) storage.Versioner {
+	for repo != nil {
+		if v, ok := repo.(storage.Versioner); ok {
+			return v
+		}
+		repo = storage.Unwrap(repo)
+	}
+	return nil
+}
+
+// getVersioned reads a metric with its version, which is 0 when the storage
+// does not track versions.
+func (h *Handler) getVersioned(r *http.Request, metricType, name string) (models.Metrics, int64, error) {
+	if v := versioner(h.Repo); v != nil {
+		return v.GetVersioned(r.Context(), metricType, name)
+	}
+	m, err := h.Repo.Get(r.Context(), metricType, name)
+	return m, 0, err
+}
+
+func (h *Handler) writeValue(w http.ResponseWriter, r *http.Request, metricType, name string) {
+	m, version, err := h.getVersioned(r, metricType, name)
+	if err != nil {
+		h.writeStorageError(w, err)
+		return
+	}
+	writeVersionedValue(w, m, version)
+}
+
+func writeVersionedValue(w http.ResponseWriter, m models.Metrics, version int64) {
+	if version > 0 {
+		w.Header().Set(MetricVersionHeader, strconv.FormatInt(version, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, m.ValueString())
+}
+
+func parseWatch(r *http.Request) (wait time.Duration, since int64, err error) {
+	q := r.URL.Query()
+	wait, err = time.ParseDuration(q.Get("wait"))
+	if err != nil || wait < 0 {
+		return 0, 0, errors.New("wait must be a non-negative duration such as 30s")
+	}
+	if s := q.Get("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || since < 0 {
+			return 0, 0, errors.New("since must be a metric version")
+		}
+	}
+	return min(wait, maxWatchWait), since, nil
+}
+
+// watchMetric blocks until the version of the metric differs from ?since=
+// or ?wait= expires, and answers 304 Not Modified in the latter case. A
+// missing since waits for the metric to exist.
+func (h *Handler) watchMetric(w http.ResponseWriter, r *http.Request, metricType, name string) {
+	wait, since, err := parseWatch(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if metricType != "gauge" && metricType != "counter" {
+		h.writeStorageError(w, fmt.Errorf("%w: %s", storage.ErrUnsupportedType, metricType))
+		return
+	}
+	v := versioner(h.Repo)
+	if v == nil {
+		writeError(w, http.StatusNotImplemented, "storage does not track metric versions")
+		return
+	}
+
+	var changed <-chan models.Metrics
+	var closing <-chan struct{}
+	if h.broadcast != nil {
+		sub := h.broadcast.Subscribe(func(m models.Metrics) bool {
+			return m.MType == metricType && m.ID == name
+		})
+		defer h.broadcast.Unsubscribe(sub)
+		changed = sub.C
+		closing = h.broadcast.Done()
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	poll := time.NewTicker(watchPoll)
+	defer poll.Stop()
+
+	for {
+		m, version, err := v.GetVersioned(r.Context(), metricType, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			err = nil
+		}
+		if err != nil {
+			h.writeStorageError(w, err)
+			return
+		}
+		if version != since {
+			writeVersionedValue(w, m, version)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case _, ok := <-changed:
+			if !ok {
+				changed = nil
+			}
+			continue
+		case <-poll.C:
+			continue
+		case <-timeout.C:
+		case <-closing:
+			// The server is shutting down; answer as if the wait expired.
+		}
+		if version == 0 {
+			h.writeStorageError(w, storage.ErrNotFound)
+			return
+		}
+		w.Header().Set(MetricVersionHeader, strconv.FormatInt(version, 10))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+}
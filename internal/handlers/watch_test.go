@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/broadcast"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWatchMetric(t *testing.T) {
+	tests := []struct {
+		name       string
+		broadcast  bool
+		target     string
+		update     string
+		wantStatus int
+		wantBody   string
+		wantVer    string
+	}{
+		{name: "without wait", target: "/value/gauge/Ready", wantStatus: http.StatusOK, wantBody: "1\n", wantVer: "1"},
+		{name: "changed since", target: "/value/gauge/Ready?wait=1m&since=0", wantStatus: http.StatusOK, wantBody: "1\n", wantVer: "1"},
+		{name: "broadcast wakes up", broadcast: true, target: "/value/gauge/Ready?wait=1m&since=1", update: "/update/gauge/Ready/3", wantStatus: http.StatusOK, wantBody: "3\n", wantVer: "2"},
+		{name: "poll without broadcast", target: "/value/gauge/Ready?wait=1m&since=1", update: "/update/gauge/Ready/3", wantStatus: http.StatusOK, wantBody: "3\n", wantVer: "2"},
+		{name: "waits for creation", broadcast: true, target: "/value/counter/Rollouts?wait=1m", update: "/update/counter/Rollouts/2", wantStatus: http.StatusOK, wantBody: "2\n", wantVer: "1"},
+		{name: "timeout", broadcast: true, target: "/value/gauge/Ready?wait=50ms&since=1", wantStatus: http.StatusNotModified, wantVer: "1"},
+		{name: "timeout on missing metric", target: "/value/gauge/Missing?wait=10ms", wantStatus: http.StatusNotFound},
+		{name: "bad wait", target: "/value/gauge/Ready?wait=soon", wantStatus: http.StatusBadRequest},
+		{name: "bad since", target: "/value/gauge/Ready?wait=1s&since=x", wantStatus: http.StatusBadRequest},
+		{name: "bad type", target: "/value/histogram/Ready?wait=1s", wantStatus: http.StatusNotImplemented},
+	}
+
+	old := watchPoll
+	watchPoll = 20 * time.Millisecond
+	defer func() { watchPoll = old }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewMemStorage()
+			require.NoError(t, repo.Add(context.Background(), storagetest.Gauge("Ready", 1)))
+			h := NewHandler(repo, zap.NewNop().Sugar())
+			b := broadcast.New(10)
+			if tt.broadcast {
+				h.SetBroadcaster(b)
+			}
+			r := chi.NewRouter()
+			h.RegisterRoutes(r)
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+				done <- w
+			}()
+			if tt.update != "" {
+				if tt.broadcast {
+					require.Eventually(t, b.HasSubscribers, time.Second, time.Millisecond)
+				} else {
+					time.Sleep(2 * watchPoll)
+				}
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, tt.update, nil))
+			}
+
+			var w *httptest.ResponseRecorder
+			select {
+			case w = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watch did not return")
+			}
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantVer, w.Header().Get(MetricVersionHeader))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWatchMetricEndsOnShutdown(t *testing.T) {
+	repo := storage.NewMemStorage()
+	require.NoError(t, repo.Add(context.Background(), storagetest.Gauge("Ready", 1)))
+	h := NewHandler(repo, zap.NewNop().Sugar())
+	b := broadcast.New(10)
+	h.SetBroadcaster(b)
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/value/gauge/Ready?wait=5m&since=1", nil))
+		done <- w
+	}()
+	require.Eventually(t, b.HasSubscribers, time.Second, time.Millisecond)
+	b.Close()
+
+	select {
+	case w := <-done:
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Equal(t, "1", w.Header().Get(MetricVersionHeader))
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not end when the broadcaster was closed")
+	}
+}
@@ -0,0 +1,142 @@
+package history
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+type Sample struct {
+	TS    time.Time
+	Value float64
+}
+
+// ring is a fixed-size circular buffer of samples.
+type ring struct {
+	samples []Sample
+	next    int
+	full    bool
+}
+
+func (r *ring) add(s Sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) list() []Sample {
+	if !r.full {
+		return append([]Sample(nil), r.samples[:r.next]...)
+	}
+	out := make([]Sample, 0, len(r.samples))
+	out = append(out, r.samples[r.next:]...)
+	return append(out, r.samples[:r.next]...)
+}
+
+type key struct {
+	mtype string
+	name  string
+}
+
+// Store keeps the most recent samples of every metric in memory.
+type Store struct {
+	size int
+
+	mu     sync.RWMutex
+	series map[key]*ring
+}
+
+func NewStore(size int) *Store {
+	return &Store{size: size, series: make(map[key]*ring)}
+}
+
+func value(m models.Metrics) (float64, bool) {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return *m.Value, true
+	case m.MType == "counter" && m.Delta != nil:
+		return float64(*m.Delta), true
+	}
+	return 0, false
+}
+
+// Record appends the current value of every metric as a sample taken at ts.
+func (s *Store) Record(ts time.Time, metrics []models.Metrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range metrics {
+		v, ok := value(m)
+		if !ok {
+			continue
+		}
+		k := key{m.MType, m.ID}
+		r, ok := s.series[k]
+		if !ok {
+			r = &ring{samples: make([]Sample, s.size)}
+			s.series[k] = r
+		}
+		r.add(Sample{TS: ts, Value: v})
+	}
+}
+
+// Samples returns the recorded samples of a metric, oldest first.
+func (s *Store) Samples(metricType, name string) []Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.series[key{metricType, name}]
+	if !ok {
+		return nil
+	}
+	return r.list()
+}
+
+// Series is the recorded history of one metric.
+type Series struct {
+	Type    string
+	Name    string
+	Samples []Sample
+}
+
+// Select returns the series for which match reports true, each with its
+// samples oldest first.
+func (s *Store) Select(match func(metricType, name string) bool) []Series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []Series
+	for k, r := range s.series {
+		if match(k.mtype, k.name) {
+			result = append(result, Series{Type: k.mtype, Name: k.name, Samples: r.list()})
+		}
+	}
+	return result
+}
+
+type lister interface {
+	GetAll(ctx context.Context) ([]models.Metrics, error)
+}
+
+// Run samples repo every interval until ctx is done.
+func (s *Store) Run(ctx context.Context, repo lister, interval time.Duration, onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			metrics, err := repo.GetAll(ctx)
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+			s.Record(now, metrics)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreKeepsMostRecentSamples(t *testing.T) {
+	s := NewStore(3)
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 5; i++ {
+		v, d := float64(i), int64(i*10)
+		s.Record(start.Add(time.Duration(i)*time.Second), []models.Metrics{
+			{ID: "Alloc", MType: "gauge", Value: &v},
+			{ID: "Alloc", MType: "counter", Delta: &d},
+		})
+	}
+
+	gauge := s.Samples("gauge", "Alloc")
+	require.Len(t, gauge, 3)
+	assert.Equal(t, []float64{2, 3, 4}, []float64{gauge[0].Value, gauge[1].Value, gauge[2].Value})
+	assert.Equal(t, start.Add(2*time.Second), gauge[0].TS)
+
+	counter := s.Samples("counter", "Alloc")
+	require.Len(t, counter, 3)
+	assert.Equal(t, 40.0, counter[2].Value)
+
+	assert.Nil(t, s.Samples("gauge", "Missing"))
+
+	selected := s.Select(func(metricType, name string) bool { return metricType == "counter" })
+	require.Len(t, selected, 1)
+	assert.Equal(t, "Alloc", selected[0].Name)
+	assert.Equal(t, counter, selected[0].Samples)
+
+	partial := NewStore(3)
+	v := 1.0
+	partial.Record(start, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &v}})
+	assert.Len(t, partial.Samples("gauge", "Alloc"), 1)
+}
@@ -0,0 +1,185 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+const flushTimeout = 10 * time.Second
+
+var (
+	ErrQueueFull = fmt.Errorf("%w: ingest queue is full", storage.ErrOverloaded)
+	ErrClosed    = fmt.Errorf("%w: ingest queue is closed", storage.ErrUnavailable)
+)
+
+type Config struct {
+	QueueSize     int
+	FlushInterval time.Duration
+	FlushBatch    int
+	OnFlushError  func(err error)
+}
+
+// Queue is a storage.Repository that accepts writes into a bounded channel and
+// applies them to the underlying repository in coalesced batches. Reads go
+// straight to the underlying repository.
+type Queue struct {
+	storage.Repository
+	cfg Config
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan []models.Metrics
+	done   chan struct{}
+
+	gauges   map[string]float64
+	counters map[string]int64
+	received int
+}
+
+func NewQueue(repo storage.Repository, cfg Config) (*Queue, error) {
+	switch {
+	case cfg.QueueSize <= 0:
+		return nil, fmt.Errorf("queue size must be positive, got %d", cfg.QueueSize)
+	case cfg.FlushInterval <= 0:
+		return nil, fmt.Errorf("flush interval must be positive, got %s", cfg.FlushInterval)
+	case cfg.FlushBatch <= 0:
+		return nil, fmt.Errorf("flush batch must be positive, got %d", cfg.FlushBatch)
+	}
+	q := &Queue{
+		Repository: repo,
+		cfg:        cfg,
+		ch:         make(chan []models.Metrics, cfg.QueueSize),
+		done:       make(chan struct{}),
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+	}
+	go q.run()
+	return q, nil
+}
+
+func (q *Queue) Add(ctx context.Context, m models.Metrics) error {
+	return q.AddBatch(ctx, []models.Metrics{m})
+}
+
+func (q *Queue) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := storage.Validate(m); err != nil {
+			return err
+		}
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrClosed
+	}
+
+	select {
+	case q.ch <- metrics:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *Queue) DefersWrites() bool {
+	return true
+}
+
+func (q *Queue) Unwrap() storage.Repository {
+	return q.Repository
+}
+
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return q.flush(ctx)
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case metrics, ok := <-q.ch:
+			if !ok {
+				return
+			}
+			q.merge(metrics)
+			if q.received >= q.cfg.FlushBatch {
+				q.flushAndReport()
+			}
+		case <-ticker.C:
+			q.flushAndReport()
+		}
+	}
+}
+
+func (q *Queue) merge(metrics []models.Metrics) {
+	for _, m := range metrics {
+		switch m.MType {
+		case "gauge":
+			q.gauges[m.ID] = *m.Value
+		case "counter":
+			q.counters[m.ID] += *m.Delta
+		}
+	}
+	q.received += len(metrics)
+}
+
+func (q *Queue) flushAndReport() {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := q.flush(ctx); err != nil && q.cfg.OnFlushError != nil {
+		q.cfg.OnFlushError(err)
+	}
+}
+
+func (q *Queue) flush(ctx context.Context) error {
+	if len(q.gauges) == 0 && len(q.counters) == 0 {
+		return nil
+	}
+
+	batch := make([]models.Metrics, 0, len(q.gauges)+len(q.counters))
+	for name, v := range q.gauges {
+		batch = append(batch, models.Metrics{ID: name, MType: "gauge", Value: &v})
+	}
+	for name, d := range q.counters {
+		batch = append(batch, models.Metrics{ID: name, MType: "counter", Delta: &d})
+	}
+
+	q.received = 0
+	if err := q.Repository.AddBatch(ctx, batch); err != nil {
+		if errors.Is(err, storage.ErrAmbiguousCommit) && len(q.counters) > 0 {
+			// The batch may have been applied, and sending the deltas again
+			// could count them twice. Gauges are kept and retried.
+			n := len(q.counters)
+			q.counters = make(map[string]int64)
+			return fmt.Errorf("dropped %d counter deltas: %w", n, err)
+		}
+		return err
+	}
+
+	q.gauges = make(map[string]float64)
+	q.counters = make(map[string]int64)
+	return nil
+}
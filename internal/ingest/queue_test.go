@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingRepo struct {
+	*storage.MemStorage
+	batches atomic.Int64
+	block   chan struct{}
+}
+
+func (r *countingRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.batches.Add(1)
+	return r.MemStorage.AddBatch(ctx, metrics)
+}
+
+func TestQueueCoalescesUpdates(t *testing.T) {
+	ctx := context.Background()
+	repo := &countingRepo{MemStorage: storage.NewMemStorage()}
+	q, err := NewQueue(repo, Config{QueueSize: 100, FlushInterval: time.Hour, FlushBatch: 1000})
+	require.NoError(t, err)
+
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, q.Add(ctx, storagetest.Counter("PollCount", 1)))
+		require.NoError(t, q.Add(ctx, storagetest.Gauge("Alloc", float64(i))))
+	}
+
+	assert.ErrorIs(t, q.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge"}), storage.ErrInvalidValue)
+
+	require.NoError(t, q.Close(ctx))
+	assert.Equal(t, int64(1), repo.batches.Load())
+
+	m, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *m.Delta)
+
+	m, err = repo.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, *m.Value)
+
+	assert.ErrorIs(t, q.Add(ctx, storagetest.Counter("PollCount", 1)), ErrClosed)
+}
+
+// ambiguousRepo applies the first batch and then reports that the commit
+// outcome is unknown, like a DB whose connection broke after COMMIT.
+type ambiguousRepo struct {
+	*storage.MemStorage
+	failed bool
+}
+
+func (r *ambiguousRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	if err := r.MemStorage.AddBatch(ctx, metrics); err != nil {
+		return err
+	}
+	if !r.failed {
+		r.failed = true
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, storage.ErrAmbiguousCommit)
+	}
+	return nil
+}
+
+func TestQueueDropsCountersAfterAmbiguousCommit(t *testing.T) {
+	ctx := context.Background()
+	repo := &ambiguousRepo{MemStorage: storage.NewMemStorage()}
+	q, err := NewQueue(repo, Config{QueueSize: 100, FlushInterval: time.Hour, FlushBatch: 1000})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Add(ctx, storagetest.Counter("PollCount", 5)))
+	require.NoError(t, q.Add(ctx, storagetest.Gauge("Alloc", 1)))
+	assert.ErrorIs(t, q.Close(ctx), storage.ErrAmbiguousCommit)
+	require.NoError(t, q.flush(ctx))
+
+	m, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *m.Delta, "counter deltas must not be applied twice")
+	assert.Empty(t, q.gauges, "gauges are retried")
+}
+
+func TestNewQueueRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "queue size", cfg: Config{QueueSize: 0, FlushInterval: time.Second, FlushBatch: 1}},
+		{name: "flush interval", cfg: Config{QueueSize: 1, FlushInterval: 0, FlushBatch: 1}},
+		{name: "flush batch", cfg: Config{QueueSize: 1, FlushInterval: time.Second, FlushBatch: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewQueue(storage.NewMemStorage(), tt.cfg)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestQueueFlushesByBatchSize(t *testing.T) {
+	ctx := context.Background()
+	repo := &countingRepo{MemStorage: storage.NewMemStorage()}
+	q, err := NewQueue(repo, Config{QueueSize: 100, FlushInterval: time.Hour, FlushBatch: 2})
+	require.NoError(t, err)
+	defer q.Close(ctx)
+
+	require.NoError(t, q.AddBatch(ctx, []models.Metrics{storagetest.Counter("PollCount", 1), storagetest.Counter("PollCount", 2)}))
+
+	assert.Eventually(t, func() bool {
+		m, err := repo.Get(ctx, "counter", "PollCount")
+		return err == nil && *m.Delta == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueBackpressure(t *testing.T) {
+	ctx := context.Background()
+	repo := &countingRepo{MemStorage: storage.NewMemStorage(), block: make(chan struct{})}
+	q, err := NewQueue(repo, Config{QueueSize: 1, FlushInterval: time.Hour, FlushBatch: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Add(ctx, storagetest.Counter("PollCount", 1)))
+
+	err = nil
+	for i := 0; i < 10 && err == nil; i++ {
+		err = q.Add(ctx, storagetest.Counter("PollCount", 1))
+	}
+	assert.ErrorIs(t, err, ErrQueueFull)
+
+	close(repo.block)
+	require.NoError(t, q.Close(ctx))
+}
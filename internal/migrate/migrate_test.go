@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		want    []int64
+		wantErr bool
+	}{
+		{
+			name: "sorted by version",
+			fsys: fstest.MapFS{
+				"0002_add_index.up.sql":   {Data: []byte("CREATE INDEX;")},
+				"0002_add_index.down.sql": {Data: []byte("DROP INDEX;")},
+				"0001_init.up.sql":        {Data: []byte("CREATE TABLE;")},
+				"0010_later.up.sql":       {Data: []byte("ALTER TABLE;")},
+			},
+			want: []int64{1, 2, 10},
+		},
+		{
+			name: "invalid file name",
+			fsys: fstest.MapFS{
+				"init.sql": {Data: []byte("CREATE TABLE;")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "down without up",
+			fsys: fstest.MapFS{
+				"0001_init.down.sql": {Data: []byte("DROP TABLE;")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "conflicting names",
+			fsys: fstest.MapFS{
+				"0001_init.up.sql":    {Data: []byte("CREATE TABLE;")},
+				"0001_other.down.sql": {Data: []byte("DROP TABLE;")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(nil, tt.fsys, Postgres)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var got []int64
+			for _, mig := range m.migrations {
+				got = append(got, mig.Version)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func openTestDBs(t *testing.T) map[string]*Migrator {
+	t.Helper()
+	fsys := fstest.MapFS{
+		"0001_items.up.sql":     {Data: []byte("CREATE TABLE items (id BIGINT PRIMARY KEY)")},
+		"0001_items.down.sql":   {Data: []byte("DROP TABLE items")},
+		"0002_names.up.sql":     {Data: []byte("ALTER TABLE items ADD COLUMN name TEXT")},
+		"0002_names.down.sql":   {Data: []byte("ALTER TABLE items DROP COLUMN name")},
+		"0003_indexes.up.sql":   {Data: []byte("CREATE INDEX items_name ON items (name)")},
+		"0003_indexes.down.sql": {Data: []byte("DROP INDEX items_name")},
+	}
+	migrators := make(map[string]*Migrator)
+
+	sqliteDB, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "migrate.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sqliteDB.Close() })
+	migrators["sqlite"], err = New(sqliteDB, fsys, SQLite)
+	require.NoError(t, err)
+
+	if dsn := os.Getenv("TEST_DATABASE_DSN"); dsn != "" {
+		// The migrations run in a schema of their own so that they do not
+		// touch the schema_migrations table of the application.
+		adminDB, err := sql.Open("pgx", dsn)
+		require.NoError(t, err)
+		defer adminDB.Close()
+		_, err = adminDB.Exec("DROP SCHEMA IF EXISTS migrate_test CASCADE; CREATE SCHEMA migrate_test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			db, err := sql.Open("pgx", dsn)
+			if err == nil {
+				db.Exec("DROP SCHEMA IF EXISTS migrate_test CASCADE")
+				db.Close()
+			}
+		})
+
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		pgDB, err := sql.Open("pgx", dsn+sep+"search_path=migrate_test")
+		require.NoError(t, err)
+		t.Cleanup(func() { pgDB.Close() })
+		migrators["postgres"], err = New(pgDB, fsys, Postgres)
+		require.NoError(t, err)
+	}
+	return migrators
+}
+
+func applied(statuses []Status) []int64 {
+	var versions []int64
+	for _, s := range statuses {
+		if s.Applied {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigratorUpDownStatus(t *testing.T) {
+	for name, m := range openTestDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			statuses, err := m.Status(ctx)
+			assert.ErrorIs(t, err, ErrNotInitialized)
+			assert.Len(t, statuses, 3)
+			assert.Empty(t, applied(statuses))
+
+			_, err = m.Status(ctx)
+			assert.ErrorIs(t, err, ErrNotInitialized, "status must not create the schema_migrations table")
+
+			migrations, err := m.Up(ctx)
+			require.NoError(t, err)
+			assert.Len(t, migrations, 3)
+
+			statuses, err = m.Status(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []int64{1, 2, 3}, applied(statuses))
+			assert.False(t, statuses[0].AppliedAt.IsZero())
+
+			migrations, err = m.Up(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, migrations, "up is idempotent")
+
+			migrations, err = m.Down(ctx, 2)
+			require.NoError(t, err)
+			require.Len(t, migrations, 2)
+			assert.Equal(t, int64(3), migrations[0].Version)
+			assert.Equal(t, int64(2), migrations[1].Version)
+
+			statuses, err = m.Status(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []int64{1}, applied(statuses))
+
+			migrations, err = m.Up(ctx)
+			require.NoError(t, err)
+			assert.Len(t, migrations, 2)
+		})
+	}
+}
@@ -1,8 +1,25 @@
 package models
 
+import "strconv"
+
+// NextCursorHeader carries the cursor of the next page of /api/metrics; it is
+// absent on the last page.
+const NextCursorHeader = "X-Next-Cursor"
+
 type Metrics struct {
 	ID    string   `json:"id"`
 	MType string   `json:"type"`
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
 }
+
+func (m Metrics) ValueString() string {
+	switch {
+	case m.Value != nil:
+		return strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	case m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10)
+	default:
+		return ""
+	}
+}
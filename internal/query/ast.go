@@ -0,0 +1,118 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// ValueType is the type an expression evaluates to.
+type ValueType string
+
+const (
+	TypeScalar ValueType = "scalar"
+	TypeVector ValueType = "vector"
+	TypeMatrix ValueType = "matrix"
+)
+
+// Expr is a node of a parsed query.
+type Expr interface {
+	Type() ValueType
+}
+
+type NumberLiteral struct {
+	Val float64
+}
+
+// VectorSelector selects the latest sample of every series whose labels
+// satisfy all matchers.
+type VectorSelector struct {
+	Matchers []*Matcher
+}
+
+// MatrixSelector selects the samples of a window ending at the evaluation
+// time, as in name[5m].
+type MatrixSelector struct {
+	Vector *VectorSelector
+	Range  time.Duration
+}
+
+type Call struct {
+	Func string
+	Arg  Expr
+}
+
+// AggregateExpr folds a vector into one sample per group, as in
+// sum by (source) (expr).
+type AggregateExpr struct {
+	Op       string
+	Grouping []string
+	Without  bool
+	Expr     Expr
+}
+
+type BinaryExpr struct {
+	Op       string
+	LHS, RHS Expr
+}
+
+type UnaryExpr struct {
+	Expr Expr
+}
+
+func (*NumberLiteral) Type() ValueType  { return TypeScalar }
+func (*VectorSelector) Type() ValueType { return TypeVector }
+func (*MatrixSelector) Type() ValueType { return TypeMatrix }
+func (*Call) Type() ValueType           { return TypeVector }
+func (*AggregateExpr) Type() ValueType  { return TypeVector }
+func (*UnaryExpr) Type() ValueType      { return TypeVector }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == TypeScalar && e.RHS.Type() == TypeScalar {
+		return TypeScalar
+	}
+	return TypeVector
+}
+
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher tests one label; a missing label has the empty value.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+func NewMatcher(name string, t MatchType, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Type: t, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
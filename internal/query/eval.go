@@ -0,0 +1,433 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/history"
+)
+
+// DefaultLookback is how far back an instant selector looks for the latest
+// sample of a series.
+const DefaultLookback = 5 * time.Minute
+
+// MaxRangePoints caps the number of steps of a range query.
+const MaxRangePoints = 11000
+
+// Value is the result of evaluating an expression: Scalar, Vector or Matrix.
+type Value interface {
+	Type() ValueType
+}
+
+type Scalar struct {
+	T time.Time
+	V float64
+}
+
+type Sample struct {
+	Labels Labels
+	T      time.Time
+	V      float64
+}
+
+type Vector []Sample
+
+type Series struct {
+	Labels Labels
+	Points []history.Sample
+}
+
+type Matrix []Series
+
+func (Scalar) Type() ValueType { return TypeScalar }
+func (Vector) Type() ValueType { return TypeVector }
+func (Matrix) Type() ValueType { return TypeMatrix }
+
+// Selector is the sample source, implemented by history.Store.
+type Selector interface {
+	Select(match func(metricType, name string) bool) []history.Series
+}
+
+type Engine struct {
+	src      Selector
+	lookback time.Duration
+}
+
+func NewEngine(src Selector) *Engine {
+	return &Engine{src: src, lookback: DefaultLookback}
+}
+
+// Instant evaluates expr at ts.
+func (e *Engine) Instant(expr Expr, ts time.Time) (Value, error) {
+	ev := e.load(expr)
+	v, err := ev.eval(expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case Vector:
+		sort.Slice(v, func(i, j int) bool { return v[i].Labels.key() < v[j].Labels.key() })
+	case Matrix:
+		sortMatrix(v)
+	}
+	return v, nil
+}
+
+// Range evaluates expr at every step from start to end inclusive and
+// returns one series per label set.
+func (e *Engine) Range(expr Expr, start, end time.Time, step time.Duration) (Matrix, error) {
+	if expr.Type() == TypeMatrix {
+		return nil, errors.New("range queries need a scalar or instant vector expression")
+	}
+	if step <= 0 {
+		return nil, errors.New("step must be positive")
+	}
+	if end.Before(start) {
+		return nil, errors.New("end must not be before start")
+	}
+	if end.Sub(start)/step >= MaxRangePoints {
+		return nil, fmt.Errorf("too many points: at most %d steps are allowed", MaxRangePoints)
+	}
+
+	ev := e.load(expr)
+	series := make(map[string]*Series)
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		v, err := ev.eval(expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case Scalar:
+			appendPoint(series, Labels{}, ts, v.V)
+		case Vector:
+			for _, s := range v {
+				appendPoint(series, s.Labels, ts, s.V)
+			}
+		}
+	}
+
+	result := make(Matrix, 0, len(series))
+	for _, s := range series {
+		result = append(result, *s)
+	}
+	sortMatrix(result)
+	return result, nil
+}
+
+func appendPoint(series map[string]*Series, labels Labels, ts time.Time, v float64) {
+	k := labels.key()
+	s, ok := series[k]
+	if !ok {
+		s = &Series{Labels: labels}
+		series[k] = s
+	}
+	s.Points = append(s.Points, history.Sample{TS: ts, Value: v})
+}
+
+func sortMatrix(m Matrix) {
+	sort.Slice(m, func(i, j int) bool { return m[i].Labels.key() < m[j].Labels.key() })
+}
+
+// evaluator holds the series of every selector of one query, loaded once so
+// that range queries do not copy the history at each step.
+type evaluator struct {
+	lookback time.Duration
+	series   map[*VectorSelector][]Series
+}
+
+func (e *Engine) load(expr Expr) *evaluator {
+	ev := &evaluator{lookback: e.lookback, series: make(map[*VectorSelector][]Series)}
+	var walk func(expr Expr)
+	walk = func(expr Expr) {
+		switch n := expr.(type) {
+		case *VectorSelector:
+			ev.series[n] = e.selectSeries(n.Matchers)
+		case *MatrixSelector:
+			walk(n.Vector)
+		case *Call:
+			walk(n.Arg)
+		case *AggregateExpr:
+			walk(n.Expr)
+		case *BinaryExpr:
+			walk(n.LHS)
+			walk(n.RHS)
+		case *UnaryExpr:
+			walk(n.Expr)
+		}
+	}
+	walk(expr)
+	return ev
+}
+
+func (e *Engine) selectSeries(matchers []*Matcher) []Series {
+	var result []Series
+	for _, s := range e.src.Select(func(metricType, name string) bool {
+		labels := metricLabels(metricType, name)
+		for _, m := range matchers {
+			if !m.Matches(labels[m.Name]) {
+				return false
+			}
+		}
+		return true
+	}) {
+		result = append(result, Series{Labels: metricLabels(s.Type, s.Name), Points: s.Samples})
+	}
+	return result
+}
+
+func (ev *evaluator) eval(expr Expr, ts time.Time) (Value, error) {
+	switch n := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{T: ts, V: n.Val}, nil
+	case *VectorSelector:
+		return ev.instant(n, ts), nil
+	case *MatrixSelector:
+		return ev.window(n, ts), nil
+	case *Call:
+		arg, err := ev.eval(n.Arg, ts)
+		if err != nil {
+			return nil, err
+		}
+		return call(n.Func, arg.(Matrix), ts), nil
+	case *AggregateExpr:
+		arg, err := ev.eval(n.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(n, arg.(Vector), ts), nil
+	case *UnaryExpr:
+		arg, err := ev.eval(n.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		vec := arg.(Vector)
+		out := make(Vector, len(vec))
+		for i, s := range vec {
+			out[i] = Sample{Labels: s.Labels.without(NameLabel), T: ts, V: -s.V}
+		}
+		return out, nil
+	case *BinaryExpr:
+		lhs, err := ev.eval(n.LHS, ts)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(n.RHS, ts)
+		if err != nil {
+			return nil, err
+		}
+		return binary(n.Op, lhs, rhs, ts)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", expr)
+}
+
+func (ev *evaluator) instant(sel *VectorSelector, ts time.Time) Vector {
+	var out Vector
+	for _, s := range ev.series[sel] {
+		i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].TS.After(ts) }) - 1
+		if i < 0 || ts.Sub(s.Points[i].TS) > ev.lookback {
+			continue
+		}
+		out = append(out, Sample{Labels: s.Labels, T: ts, V: s.Points[i].Value})
+	}
+	return out
+}
+
+// window returns the samples in (ts-range, ts].
+func (ev *evaluator) window(sel *MatrixSelector, ts time.Time) Matrix {
+	from := ts.Add(-sel.Range)
+	var out Matrix
+	for _, s := range ev.series[sel.Vector] {
+		lo := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].TS.After(from) })
+		hi := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].TS.After(ts) })
+		if lo < hi {
+			out = append(out, Series{Labels: s.Labels, Points: s.Points[lo:hi]})
+		}
+	}
+	return out
+}
+
+func call(name string, m Matrix, ts time.Time) Vector {
+	var out Vector
+	for _, s := range m {
+		v, ok := overTime(name, s.Points)
+		if !ok {
+			continue
+		}
+		labels := s.Labels
+		if name != "last_over_time" {
+			labels = labels.without(NameLabel)
+		}
+		out = append(out, Sample{Labels: labels, T: ts, V: v})
+	}
+	return out
+}
+
+// overTime folds the samples of a window. rate and increase are not
+// extrapolated to the window edges: they cover the span between the first
+// and the last sample, treating any decrease as a counter reset.
+func overTime(name string, points []history.Sample) (float64, bool) {
+	switch name {
+	case "rate", "increase":
+		if len(points) < 2 {
+			return 0, false
+		}
+		var inc float64
+		for i := 1; i < len(points); i++ {
+			d := points[i].Value - points[i-1].Value
+			if d < 0 {
+				d = points[i].Value
+			}
+			inc += d
+		}
+		if name == "increase" {
+			return inc, true
+		}
+		span := points[len(points)-1].TS.Sub(points[0].TS).Seconds()
+		if span <= 0 {
+			return 0, false
+		}
+		return inc / span, true
+	case "count_over_time":
+		return float64(len(points)), true
+	case "last_over_time":
+		return points[len(points)-1].Value, true
+	}
+
+	acc := points[0].Value
+	for _, p := range points[1:] {
+		switch name {
+		case "sum_over_time", "avg_over_time":
+			acc += p.Value
+		case "min_over_time":
+			acc = math.Min(acc, p.Value)
+		case "max_over_time":
+			acc = math.Max(acc, p.Value)
+		}
+	}
+	if name == "avg_over_time" {
+		acc /= float64(len(points))
+	}
+	return acc, true
+}
+
+func aggregate(n *AggregateExpr, vec Vector, ts time.Time) Vector {
+	type group struct {
+		labels Labels
+		acc    float64
+		count  int
+	}
+	groups := make(map[string]*group)
+	var order []string
+	drop := append(slices.Clone(n.Grouping), NameLabel)
+	for _, s := range vec {
+		var labels Labels
+		if n.Without {
+			labels = s.Labels.without(drop...)
+		} else {
+			labels = s.Labels.only(n.Grouping)
+		}
+		k := labels.key()
+		g, ok := groups[k]
+		if !ok {
+			groups[k] = &group{labels: labels, acc: s.V, count: 1}
+			order = append(order, k)
+			continue
+		}
+		g.count++
+		switch n.Op {
+		case "sum", "avg":
+			g.acc += s.V
+		case "min":
+			g.acc = math.Min(g.acc, s.V)
+		case "max":
+			g.acc = math.Max(g.acc, s.V)
+		}
+	}
+
+	out := make(Vector, 0, len(groups))
+	for _, k := range order {
+		g := groups[k]
+		v := g.acc
+		switch n.Op {
+		case "avg":
+			v /= float64(g.count)
+		case "count":
+			v = float64(g.count)
+		}
+		out = append(out, Sample{Labels: g.labels, T: ts, V: v})
+	}
+	return out
+}
+
+func arith(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	}
+	return math.NaN()
+}
+
+// binary matches vector operands one-to-one on all labels but the name.
+func binary(op string, lhs, rhs Value, ts time.Time) (Value, error) {
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			return Scalar{T: ts, V: arith(op, l.V, r.V)}, nil
+		case Vector:
+			out := make(Vector, len(r))
+			for i, s := range r {
+				out[i] = Sample{Labels: s.Labels.without(NameLabel), T: ts, V: arith(op, l.V, s.V)}
+			}
+			return out, nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			out := make(Vector, len(l))
+			for i, s := range l {
+				out[i] = Sample{Labels: s.Labels.without(NameLabel), T: ts, V: arith(op, s.V, r.V)}
+			}
+			return out, nil
+		case Vector:
+			right, err := indexVector(r, "right")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := indexVector(l, "left"); err != nil {
+				return nil, err
+			}
+			var out Vector
+			for _, s := range l {
+				labels := s.Labels.without(NameLabel)
+				if m, ok := right[labels.key()]; ok {
+					out = append(out, Sample{Labels: labels, T: ts, V: arith(op, s.V, m.V)})
+				}
+			}
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operands %s %s %s", lhs.Type(), op, rhs.Type())
+}
+
+func indexVector(vec Vector, side string) (map[string]Sample, error) {
+	index := make(map[string]Sample, len(vec))
+	for _, s := range vec {
+		k := s.Labels.without(NameLabel).key()
+		if _, ok := index[k]; ok {
+			return nil, fmt.Errorf("many-to-many matching not allowed: several series on the %s-hand side share labels %v", side, s.Labels.without(NameLabel))
+		}
+		index[k] = s
+	}
+	return index, nil
+}
@@ -0,0 +1,69 @@
+package query
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	NameLabel = "__name__"
+	TypeLabel = "type"
+	// SourceLabel holds the federation source a metric was pulled from, taken
+	// from the "source/" prefix of its ID.
+	SourceLabel = "source"
+)
+
+type Labels map[string]string
+
+// metricLabels derives the labels of a stored metric.
+func metricLabels(metricType, id string) Labels {
+	l := Labels{NameLabel: id, TypeLabel: metricType}
+	if i := strings.LastIndexByte(id, '/'); i > 0 && i < len(id)-1 {
+		l[SourceLabel] = id[:i]
+		l[NameLabel] = id[i+1:]
+	}
+	return l
+}
+
+func (l Labels) names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// key identifies a label set; it is also the order in which results are
+// returned.
+func (l Labels) key() string {
+	var b strings.Builder
+	for _, name := range l.names() {
+		b.WriteString(name)
+		b.WriteByte(0xfe)
+		b.WriteString(l[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+func (l Labels) without(names ...string) Labels {
+	out := make(Labels, len(l))
+	for k, v := range l {
+		out[k] = v
+	}
+	for _, name := range names {
+		delete(out, name)
+	}
+	return out
+}
+
+func (l Labels) only(names []string) Labels {
+	out := make(Labels, len(names))
+	for _, name := range names {
+		if v, ok := l[name]; ok {
+			out[name] = v
+		}
+	}
+	return out
+}
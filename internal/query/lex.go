@@ -0,0 +1,253 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokLBrace
+	tokRBrace
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokEq
+	tokNeq
+	tokRegexEq
+	tokRegexNeq
+	tokAdd
+	tokSub
+	tokMul
+	tokDiv
+)
+
+var tokenNames = map[tokenKind]string{
+	tokEOF:      "end of input",
+	tokIdent:    "identifier",
+	tokNumber:   "number",
+	tokDuration: "duration",
+	tokString:   "string",
+	tokLBrace:   `"{"`,
+	tokRBrace:   `"}"`,
+	tokLParen:   `"("`,
+	tokRParen:   `")"`,
+	tokLBracket: `"["`,
+	tokRBracket: `"]"`,
+	tokComma:    `","`,
+	tokEq:       `"="`,
+	tokNeq:      `"!="`,
+	tokRegexEq:  `"=~"`,
+	tokRegexNeq: `"!~"`,
+	tokAdd:      `"+"`,
+	tokSub:      `"-"`,
+	tokMul:      `"*"`,
+	tokDiv:      `"/"`,
+}
+
+func (k tokenKind) String() string {
+	return tokenNames[k]
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var punctuation = []struct {
+	text string
+	kind tokenKind
+}{
+	// Two-character operators go first so that they win over their prefixes.
+	{"!=", tokNeq}, {"=~", tokRegexEq}, {"!~", tokRegexNeq},
+	{"{", tokLBrace}, {"}", tokRBrace}, {"(", tokLParen}, {")", tokRParen},
+	{"[", tokLBracket}, {"]", tokRBracket}, {",", tokComma}, {"=", tokEq},
+	{"+", tokAdd}, {"-", tokSub}, {"*", tokMul}, {"/", tokDiv},
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(input); {
+		c := rune(input[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case isIdentStart(c):
+			end := pos + 1
+			for end < len(input) && (isIdentStart(rune(input[end])) || isDigit(rune(input[end])) || input[end] == ':') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: input[pos:end], pos: pos})
+			pos = end
+		case isDigit(c) || c == '.' && pos+1 < len(input) && isDigit(rune(input[pos+1])):
+			tok, err := lexNumber(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			pos += len(tok.text)
+		case c == '"' || c == '\'' || c == '`':
+			tok, end, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			pos = end
+		default:
+			matched := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(input[pos:], p.text) {
+					tokens = append(tokens, token{kind: p.kind, text: p.text, pos: pos})
+					pos += len(p.text)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+func isIdentStart(c rune) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+// lexNumber reads a number, or a duration when digits are directly followed
+// by a unit, as in 5m or 1h30m.
+func lexNumber(input string, pos int) (token, error) {
+	end := pos
+	for end < len(input) && (isDigit(rune(input[end])) || isIdentStart(rune(input[end])) || input[end] == '.') {
+		end++
+	}
+	// Signed exponents such as 1e-3.
+	if end < len(input) && (input[end] == '-' || input[end] == '+') && end > pos && (input[end-1] == 'e' || input[end-1] == 'E') {
+		end++
+		for end < len(input) && isDigit(rune(input[end])) {
+			end++
+		}
+	}
+	text := input[pos:end]
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return token{kind: tokNumber, text: text, pos: pos}, nil
+	}
+	if _, err := ParseDuration(text); err == nil {
+		return token{kind: tokDuration, text: text, pos: pos}, nil
+	}
+	return token{}, fmt.Errorf("bad number or duration %q at position %d", text, pos)
+}
+
+func lexString(input string, pos int) (token, int, error) {
+	quote := input[pos]
+	end := pos + 1
+	for end < len(input) && input[end] != quote {
+		if input[end] == '\\' && quote != '`' {
+			end++
+		}
+		end++
+	}
+	if end >= len(input) {
+		return token{}, 0, fmt.Errorf("unterminated string at position %d", pos)
+	}
+	raw := input[pos : end+1]
+	if quote == '\'' {
+		// Single-quoted strings use the same escapes as double-quoted ones.
+		var b strings.Builder
+		b.WriteByte('"')
+		for i := 1; i < len(raw)-1; i++ {
+			switch {
+			case raw[i] == '\\' && raw[i+1] == '\'':
+				b.WriteByte('\'')
+				i++
+			case raw[i] == '\\':
+				b.WriteString(raw[i : i+2])
+				i++
+			case raw[i] == '"':
+				b.WriteString(`\"`)
+			default:
+				b.WriteByte(raw[i])
+			}
+		}
+		b.WriteByte('"')
+		raw = b.String()
+	}
+	text, err := strconv.Unquote(raw)
+	if err != nil {
+		return token{}, 0, fmt.Errorf("bad string at position %d: %w", pos, err)
+	}
+	return token{kind: tokString, text: text, pos: pos}, end + 1, nil
+}
+
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	// ms precedes m so that it is not read as minutes.
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"ms", time.Millisecond},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
+
+// ParseDuration parses Prometheus durations: integers with units from ms to
+// y, largest first, e.g. 1h30m.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var total time.Duration
+	last := time.Duration(math.MaxInt64)
+	for rest := s; rest != ""; {
+		i := 0
+		for i < len(rest) && isDigit(rune(rest[i])) {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %q: %w", s, err)
+		}
+		rest = rest[i:]
+		matched := false
+		for _, d := range durationUnits {
+			if strings.HasPrefix(rest, d.suffix) {
+				if d.unit >= last {
+					return 0, fmt.Errorf("bad duration %q: units must go from largest to smallest", s)
+				}
+				total += time.Duration(n) * d.unit
+				rest = rest[len(d.suffix):]
+				last = d.unit
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, fmt.Errorf("bad duration unit in %q", s)
+		}
+	}
+	return total, nil
+}
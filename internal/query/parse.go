@@ -0,0 +1,323 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var functions = map[string]bool{
+	"rate":            true,
+	"increase":        true,
+	"avg_over_time":   true,
+	"min_over_time":   true,
+	"max_over_time":   true,
+	"sum_over_time":   true,
+	"count_over_time": true,
+	"last_over_time":  true,
+}
+
+var aggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+var binaryPrecedence = map[tokenKind]int{
+	tokAdd: 1,
+	tokSub: 1,
+	tokMul: 2,
+	tokDiv: 2,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a query written in a subset of PromQL.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseBinary(1)
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of input")
+	}
+	return fmt.Errorf("unexpected %s %q at position %d", t.kind, t.text, t.pos)
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	if p.peek().kind != kind {
+		return token{}, fmt.Errorf("expected %s: %w", kind, p.unexpected())
+	}
+	return p.next(), nil
+}
+
+func (p *parser) parseBinary(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		prec, ok := binaryPrecedence[op.kind]
+		if !ok || prec < minPrec {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		if lhs.Type() == TypeMatrix || rhs.Type() == TypeMatrix {
+			return nil, fmt.Errorf("binary %s needs scalar or instant vector operands at position %d", op.text, op.pos)
+		}
+		lhs = &BinaryExpr{Op: op.text, LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	switch p.peek().kind {
+	case tokAdd:
+		p.next()
+		return p.parseUnary()
+	case tokSub:
+		t := p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		switch e := expr.(type) {
+		case *NumberLiteral:
+			return &NumberLiteral{Val: -e.Val}, nil
+		case *MatrixSelector:
+			return nil, fmt.Errorf("unary - needs a scalar or instant vector at position %d", t.pos)
+		}
+		if expr.Type() == TypeScalar {
+			return &BinaryExpr{Op: "-", LHS: &NumberLiteral{}, RHS: expr}, nil
+		}
+		return &UnaryExpr{Expr: expr}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil || p.peek().kind != tokLBracket {
+		return expr, err
+	}
+	t := p.next()
+	vs, ok := expr.(*VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("ranges are only allowed on vector selectors at position %d", t.pos)
+	}
+	d, err := p.expect(tokDuration)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokRBracket); err != nil {
+		return nil, err
+	}
+	rng, err := ParseDuration(d.text)
+	if err != nil {
+		return nil, err
+	}
+	if rng <= 0 {
+		return nil, fmt.Errorf("range must be positive at position %d", d.pos)
+	}
+	return &MatrixSelector{Vector: vs, Range: rng}, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at position %d", t.text, t.pos)
+		}
+		return &NumberLiteral{Val: v}, nil
+	case tokLParen:
+		p.next()
+		expr, err := p.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tokLBrace:
+		return p.parseSelector("")
+	case tokIdent:
+		p.next()
+		next := p.peek()
+		switch {
+		case aggregations[t.text] && (next.kind == tokLParen || next.kind == tokIdent && (next.text == "by" || next.text == "without")):
+			return p.parseAggregate(t.text)
+		case next.kind == tokLParen:
+			return p.parseCall(t)
+		case strings.EqualFold(t.text, "NaN"):
+			return &NumberLiteral{Val: math.NaN()}, nil
+		case strings.EqualFold(t.text, "Inf"):
+			return &NumberLiteral{Val: math.Inf(1)}, nil
+		}
+		return p.parseSelector(t.text)
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	var matchers []*Matcher
+	if name != "" {
+		matchers = append(matchers, &Matcher{Name: NameLabel, Type: MatchEqual, Value: name})
+	}
+	if p.peek().kind == tokLBrace {
+		p.next()
+		for p.peek().kind != tokRBrace {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokRBrace); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return &VectorSelector{Matchers: matchers}, nil
+		}
+	}
+	return nil, fmt.Errorf("vector selector must contain a matcher that does not match the empty string")
+}
+
+func (p *parser) parseMatcher() (*Matcher, error) {
+	label, err := p.expect(tokIdent)
+	if err != nil {
+		return nil, err
+	}
+	var t MatchType
+	switch op := p.next(); op.kind {
+	case tokEq:
+		t = MatchEqual
+	case tokNeq:
+		t = MatchNotEqual
+	case tokRegexEq:
+		t = MatchRegexp
+	case tokRegexNeq:
+		t = MatchNotRegexp
+	default:
+		p.pos--
+		return nil, fmt.Errorf("expected label matcher: %w", p.unexpected())
+	}
+	value, err := p.expect(tokString)
+	if err != nil {
+		return nil, err
+	}
+	return NewMatcher(label.text, t, value.text)
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	if !functions[name.text] {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+	p.next()
+	arg, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokRParen); err != nil {
+		return nil, err
+	}
+	if arg.Type() != TypeMatrix {
+		return nil, fmt.Errorf("%s() needs a range vector such as metric[5m], got %s", name.text, arg.Type())
+	}
+	return &Call{Func: name.text, Arg: arg}, nil
+}
+
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	agg := &AggregateExpr{Op: op}
+	if err := p.parseGrouping(agg); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokRParen); err != nil {
+		return nil, err
+	}
+	if expr.Type() != TypeVector {
+		return nil, fmt.Errorf("%s() needs an instant vector, got %s", op, expr.Type())
+	}
+	agg.Expr = expr
+	if agg.Grouping == nil && !agg.Without {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+// parseGrouping reads an optional by (...) or without (...) clause.
+func (p *parser) parseGrouping(agg *AggregateExpr) error {
+	t := p.peek()
+	if t.kind != tokIdent || t.text != "by" && t.text != "without" {
+		return nil
+	}
+	p.next()
+	agg.Without = t.text == "without"
+	agg.Grouping = []string{}
+	if _, err := p.expect(tokLParen); err != nil {
+		return err
+	}
+	for p.peek().kind == tokIdent {
+		agg.Grouping = append(agg.Grouping, p.next().text)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	_, err := p.expect(tokRParen)
+	return err
+}
@@ -0,0 +1,250 @@
+package query
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/history"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "5m", want: 5 * time.Minute},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "250ms", want: 250 * time.Millisecond},
+		{in: "1d", want: 24 * time.Hour},
+		{in: "30m1h", err: true},
+		{in: "5", err: true},
+		{in: "5x", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if tt.err {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestParse(t *testing.T) {
+	valid := []struct {
+		query string
+		typ   ValueType
+	}{
+		{"HeapAlloc", TypeVector},
+		{`HeapAlloc{source="dc1", type!~'count.*',}`, TypeVector},
+		{`{__name__=~"Heap.*"}`, TypeVector},
+		{"PollCount[5m]", TypeMatrix},
+		{"rate(PollCount[1m30s])", TypeVector},
+		{"sum by (source) (HeapAlloc)", TypeVector},
+		{"sum(HeapAlloc) without (type)", TypeVector},
+		{"avg_over_time(HeapAlloc[10m]) / 1024 / 1024", TypeVector},
+		{"-HeapAlloc + HeapIdle * 2", TypeVector},
+		{"(1 + 2) * -3", TypeScalar},
+		{"count(sum by (source) (rate(PollCount[5m])))", TypeVector},
+	}
+	for _, tt := range valid {
+		expr, err := Parse(tt.query)
+		require.NoError(t, err, tt.query)
+		assert.Equal(t, tt.typ, expr.Type(), tt.query)
+	}
+
+	invalid := []string{
+		"",
+		"HeapAlloc{",
+		`{source=""}`,
+		`HeapAlloc{source=dc1}`,
+		`HeapAlloc{source=~"("}`,
+		"rate(PollCount)",
+		"sum(PollCount[5m])",
+		"unknown(PollCount[5m])",
+		"PollCount[5m] + 1",
+		"HeapAlloc HeapIdle",
+		"HeapAlloc[5x]",
+		`"unterminated`,
+	}
+	for _, query := range invalid {
+		_, err := Parse(query)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	expr, err := Parse("1 - 2 - 3 * 4")
+	require.NoError(t, err)
+	v, err := NewEngine(history.NewStore(1)).Instant(expr, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, -13.0, v.(Scalar).V)
+}
+
+func TestMetricLabels(t *testing.T) {
+	assert.Equal(t, Labels{NameLabel: "HeapAlloc", TypeLabel: "gauge"}, metricLabels("gauge", "HeapAlloc"))
+	assert.Equal(t, Labels{NameLabel: "HeapAlloc", TypeLabel: "gauge", SourceLabel: "dc1"}, metricLabels("gauge", "dc1/HeapAlloc"))
+	assert.Equal(t, Labels{NameLabel: "x", TypeLabel: "counter", SourceLabel: "eu/dc1"}, metricLabels("counter", "eu/dc1/x"))
+}
+
+func newTestStore(start time.Time) *history.Store {
+	s := history.NewStore(100)
+	gauge := func(id string, v float64) models.Metrics { return models.Metrics{ID: id, MType: "gauge", Value: &v} }
+	counter := func(id string, d int64) models.Metrics { return models.Metrics{ID: id, MType: "counter", Delta: &d} }
+	// Six samples ten seconds apart; dc2/PollCount resets after the third.
+	polls := []int64{0, 10, 20, 5, 15, 25}
+	for i := 0; i < 6; i++ {
+		s.Record(start.Add(time.Duration(i)*10*time.Second), []models.Metrics{
+			gauge("dc1/HeapAlloc", float64(100+i)),
+			gauge("dc2/HeapAlloc", float64(200+i)),
+			gauge("HeapIdle", 50),
+			gauge("dc1/Frees", 1),
+			counter("dc1/PollCount", int64(i*2)),
+			counter("dc2/PollCount", polls[i]),
+		})
+	}
+	return s
+}
+
+func TestEngineInstant(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	end := start.Add(50 * time.Second)
+	e := NewEngine(newTestStore(start))
+
+	type result map[string]float64
+	tests := []struct {
+		query string
+		want  result
+	}{
+		{"HeapAlloc", result{"dc1": 105, "dc2": 205}},
+		{`HeapAlloc{source="dc2"}`, result{"dc2": 205}},
+		{`{__name__=~"Heap.*", source!="dc1"}`, result{"dc2": 205, "": 50}},
+		{"sum(HeapAlloc)", result{"": 310}},
+		{"sum by (source) (HeapAlloc)", result{"dc1": 105, "dc2": 205}},
+		{"max without (source) (HeapAlloc)", result{"": 205}},
+		{"count(HeapAlloc)", result{"": 2}},
+		{"avg(HeapAlloc) - 5", result{"": 150}},
+		{"increase(PollCount[1m])", result{"dc1": 10, "dc2": 45}},
+		{"rate(PollCount[1m])", result{"dc1": 0.2, "dc2": 0.9}},
+		{"rate(PollCount[25s])", result{"dc1": 0.2, "dc2": 1}},
+		{"avg_over_time(HeapAlloc[1m])", result{"dc1": 102.5, "dc2": 202.5}},
+		{"min_over_time(HeapAlloc[15s])", result{"dc1": 104, "dc2": 204}},
+		{"max_over_time(HeapAlloc[1m])", result{"dc1": 105, "dc2": 205}},
+		{"sum_over_time(HeapIdle[1m])", result{"": 300}},
+		{"count_over_time(HeapAlloc[30s])", result{"dc1": 3, "dc2": 3}},
+		{"last_over_time(PollCount[1m])", result{"dc1": 10, "dc2": 25}},
+		{"HeapAlloc / HeapAlloc", result{"dc1": 1, "dc2": 1}},
+		{"HeapAlloc - sum by (source) (HeapAlloc)", result{}},
+		{"HeapAlloc * 2 + HeapAlloc", result{"dc1": 315, "dc2": 615}},
+		{"-HeapAlloc", result{"dc1": -105, "dc2": -205}},
+		{"Missing", result{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			require.NoError(t, err)
+			v, err := e.Instant(expr, end)
+			require.NoError(t, err)
+			got := result{}
+			for _, s := range v.(Vector) {
+				got[s.Labels[SourceLabel]] = s.V
+				assert.Equal(t, end, s.T)
+			}
+			for k, want := range tt.want {
+				assert.InDelta(t, want, got[k], 1e-9, k)
+			}
+			assert.Len(t, got, len(tt.want))
+		})
+	}
+}
+
+func TestEngineInstantLabelsAndErrors(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	end := start.Add(50 * time.Second)
+	e := NewEngine(newTestStore(start))
+	eval := func(query string) (Value, error) {
+		expr, err := Parse(query)
+		require.NoError(t, err)
+		return e.Instant(expr, end)
+	}
+
+	v, err := eval("HeapAlloc")
+	require.NoError(t, err)
+	assert.Equal(t, Labels{NameLabel: "HeapAlloc", TypeLabel: "gauge", SourceLabel: "dc1"}, v.(Vector)[0].Labels)
+
+	v, err = eval("rate(PollCount[1m])")
+	require.NoError(t, err)
+	assert.Equal(t, Labels{TypeLabel: "counter", SourceLabel: "dc1"}, v.(Vector)[0].Labels, "functions drop the name")
+
+	v, err = eval("sum by (type) (HeapAlloc)")
+	require.NoError(t, err)
+	assert.Equal(t, Vector{{Labels: Labels{TypeLabel: "gauge"}, T: end, V: 310}}, v)
+
+	v, err = eval("HeapAlloc[20s]")
+	require.NoError(t, err)
+	m := v.(Matrix)
+	require.Len(t, m, 2)
+	assert.Len(t, m[0].Points, 2)
+
+	_, err = eval(`{source="dc1", type="gauge"} + HeapAlloc`)
+	assert.ErrorContains(t, err, "many-to-many")
+
+	v, err = eval("HeapIdle / 0")
+	require.NoError(t, err)
+	assert.True(t, math.IsInf(v.(Vector)[0].V, 1))
+
+	late := end.Add(DefaultLookback + time.Second)
+	expr, err := Parse("HeapAlloc")
+	require.NoError(t, err)
+	v, err = e.Instant(expr, late)
+	require.NoError(t, err)
+	assert.Empty(t, v, "samples older than the lookback are stale")
+}
+
+func TestEngineRange(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	e := NewEngine(newTestStore(start))
+
+	expr, err := Parse("sum(HeapAlloc)")
+	require.NoError(t, err)
+	m, err := e.Range(expr, start.Add(10*time.Second), start.Add(30*time.Second), 10*time.Second)
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Equal(t, Labels{}, m[0].Labels)
+	assert.Equal(t, []history.Sample{
+		{TS: start.Add(10 * time.Second), Value: 302},
+		{TS: start.Add(20 * time.Second), Value: 304},
+		{TS: start.Add(30 * time.Second), Value: 306},
+	}, m[0].Points)
+
+	expr, err = Parse("rate(PollCount[30s])")
+	require.NoError(t, err)
+	m, err = e.Range(expr, start, start.Add(50*time.Second), 25*time.Second)
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	assert.Len(t, m[0].Points, 2, "the first step has a single sample and no rate")
+
+	expr, err = Parse("2 * 3")
+	require.NoError(t, err)
+	m, err = e.Range(expr, start, start.Add(time.Minute), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Len(t, m[0].Points, 2)
+
+	expr, err = Parse("HeapAlloc[1m]")
+	require.NoError(t, err)
+	_, err = e.Range(expr, start, start.Add(time.Minute), time.Second)
+	assert.Error(t, err)
+	expr, err = Parse("HeapAlloc")
+	require.NoError(t, err)
+	_, err = e.Range(expr, start, start.Add(24*time.Hour), time.Second)
+	assert.ErrorContains(t, err, "too many points")
+	_, err = e.Range(expr, start.Add(time.Minute), start, time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+type Status struct {
+	Role     Role            `json:"role"`
+	Seq      uint64          `json:"seq"`
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+type ReplicaStatus struct {
+	URL   string `json:"url"`
+	Acked uint64 `json:"acked"`
+	Error string `json:"error,omitempty"`
+}
+
+type applyRequest struct {
+	Entries []Entry `json:"entries"`
+}
+
+type snapshot struct {
+	Seq     uint64           `json:"seq"`
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+type ack struct {
+	Seq uint64 `json:"seq"`
+}
+
+// RegisterRoutes mounts the replication endpoints. They are not
+// authenticated and let anyone overwrite the replica or promote it, so serve
+// them on a listener only the other nodes can reach.
+func (n *Node) RegisterRoutes(r chi.Router) {
+	r.Get("/replication/status", n.handleStatus)
+	r.Post("/replication/apply", n.handleApply)
+	r.Post("/replication/snapshot", n.handleSnapshot)
+	r.Post("/replication/promote", n.handlePromote)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (n *Node) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+func (n *Node) handleApply(w http.ResponseWriter, r *http.Request) {
+	var req applyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	seq, err := n.apply(r.Context(), req.Entries)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, ack{Seq: seq})
+	case errors.Is(err, errGap):
+		writeJSON(w, http.StatusConflict, ack{Seq: seq})
+	case errors.Is(err, errNotReplica):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (n *Node) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	var s snapshot
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	switch err := n.restore(s); {
+	case err == nil:
+		writeJSON(w, http.StatusOK, ack{Seq: s.Seq})
+	case errors.Is(err, errNotReplica):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (n *Node) handlePromote(w http.ResponseWriter, r *http.Request) {
+	n.Promote()
+	writeJSON(w, http.StatusOK, n.Status())
+}
@@ -0,0 +1,63 @@
+package replication
+
+import (
+	"sync"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+type Entry struct {
+	Seq     uint64           `json:"seq"`
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+// updateLog keeps the most recent accepted updates so that replicas that fell
+// slightly behind can catch up without a full snapshot.
+type updateLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []Entry
+	seq     uint64
+	// changed is closed and replaced whenever an entry is appended.
+	changed chan struct{}
+}
+
+func newUpdateLog(size int, seq uint64) *updateLog {
+	return &updateLog{size: size, seq: seq, changed: make(chan struct{})}
+}
+
+func (l *updateLog) append(metrics []models.Metrics) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	l.entries = append(l.entries, Entry{Seq: l.seq, Metrics: metrics})
+	if len(l.entries) > l.size {
+		l.entries = append(l.entries[:0:0], l.entries[len(l.entries)-l.size:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns up to limit entries following seq. ok is false when the
+// entries right after seq have already been dropped from the log.
+func (l *updateLog) since(seq uint64, limit int) (entries []Entry, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq >= l.seq {
+		return nil, seq == l.seq
+	}
+	if len(l.entries) == 0 || l.entries[0].Seq > seq+1 {
+		return nil, false
+	}
+	start := int(seq + 1 - l.entries[0].Seq)
+	end := min(start+limit, len(l.entries))
+	return append([]Entry(nil), l.entries[start:end]...), true
+}
+
+func (l *updateLog) current() (uint64, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.changed
+}
@@ -0,0 +1,222 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+)
+
+type Role string
+
+const (
+	RolePrimary Role = "primary"
+	RoleReplica Role = "replica"
+)
+
+// ErrReadOnly wraps storage.ErrUnavailable so that clients treat a write sent
+// to a replica like any other temporarily unavailable backend.
+var ErrReadOnly = fmt.Errorf("%w: replica does not accept writes", storage.ErrUnavailable)
+
+var (
+	errGap        = errors.New("replication gap")
+	errNotReplica = errors.New("node is not a replica")
+)
+
+type Config struct {
+	Role Role
+	// Replicas are base URLs of the servers a primary pushes updates to.
+	Replicas []string
+	// LogSize is the number of recent updates kept for catching up replicas
+	// without a snapshot.
+	LogSize int
+	Client  *http.Client
+	OnError func(replica string, err error)
+}
+
+// Node is a storage.Repository on top of MemStorage that either accepts
+// writes and streams them to replicas (primary) or applies the stream and
+// serves reads only (replica).
+type Node struct {
+	store *storage.MemStorage
+	cfg   Config
+
+	// mu orders writes with their sequence numbers and with snapshots.
+	mu      sync.Mutex
+	role    Role
+	log     *updateLog
+	pushers []*pusher
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewNode(store *storage.MemStorage, cfg Config) *Node {
+	if cfg.LogSize <= 0 {
+		cfg.LogSize = 10000
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	// State a primary starts with, e.g. restored from a file, counts as the
+	// first update, so that replicas at seq 0 fetch it in a snapshot.
+	var seq uint64
+	if cfg.Role == RolePrimary {
+		if metrics, err := store.GetAll(context.Background()); err == nil && len(metrics) > 0 {
+			seq = 1
+		}
+	}
+	n := &Node{
+		store: store,
+		cfg:   cfg,
+		role:  cfg.Role,
+		log:   newUpdateLog(cfg.LogSize, seq),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	if n.role == RolePrimary {
+		n.startPushers()
+	}
+	return n
+}
+
+func (n *Node) startPushers() {
+	for _, url := range n.cfg.Replicas {
+		p := &pusher{url: url, node: n, log: n.log}
+		n.pushers = append(n.pushers, p)
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			p.run(n.ctx)
+		}()
+	}
+}
+
+func (n *Node) Add(ctx context.Context, m models.Metrics) error {
+	return n.AddBatch(ctx, []models.Metrics{m})
+}
+
+func (n *Node) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := storage.Validate(m); err != nil {
+			return err
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != RolePrimary {
+		return ErrReadOnly
+	}
+	if err := n.store.AddBatch(ctx, metrics); err != nil {
+		return err
+	}
+	n.log.append(metrics)
+	return nil
+}
+
+func (n *Node) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	return n.store.Get(ctx, metricType, name)
+}
+
+func (n *Node) GetAll(ctx context.Context) ([]models.Metrics, error) {
+	return n.store.GetAll(ctx)
+}
+
+func (n *Node) List(ctx context.Context, opts storage.ListOptions) ([]models.Metrics, error) {
+	return n.store.List(ctx, opts)
+}
+
+func (n *Node) Ping(ctx context.Context) error {
+	return n.store.Ping(ctx)
+}
+
+func (n *Node) Unwrap() storage.Repository {
+	return n.store
+}
+
+// apply applies entries received from the primary in order and returns the
+// last applied sequence number. Entries already applied are skipped.
+func (n *Node) apply(ctx context.Context, entries []Entry) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != RoleReplica {
+		return 0, errNotReplica
+	}
+
+	for _, e := range entries {
+		seq, _ := n.log.current()
+		if e.Seq <= seq {
+			continue
+		}
+		if e.Seq != seq+1 {
+			return seq, errGap
+		}
+		if err := n.store.AddBatch(ctx, e.Metrics); err != nil {
+			return seq, err
+		}
+		n.log.append(e.Metrics)
+	}
+	seq, _ := n.log.current()
+	return seq, nil
+}
+
+func (n *Node) restore(s snapshot) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != RoleReplica {
+		return errNotReplica
+	}
+	for _, m := range s.Metrics {
+		if err := storage.Validate(m); err != nil {
+			return err
+		}
+	}
+	n.store.Restore(s.Metrics)
+	n.log = newUpdateLog(n.cfg.LogSize, s.Seq)
+	return nil
+}
+
+func (n *Node) snapshot(ctx context.Context) (snapshot, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	metrics, err := n.store.GetAll(ctx)
+	if err != nil {
+		return snapshot{}, err
+	}
+	seq, _ := n.log.current()
+	return snapshot{Seq: seq, Metrics: metrics}, nil
+}
+
+// Promote turns a replica into a primary that accepts writes and pushes them
+// to the configured replicas, continuing the sequence it has applied so far.
+func (n *Node) Promote() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == RolePrimary {
+		return
+	}
+	n.role = RolePrimary
+	n.startPushers()
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	seq, _ := n.log.current()
+	st := Status{Role: n.role, Seq: seq}
+	for _, p := range n.pushers {
+		st.Replicas = append(st.Replicas, p.status())
+	}
+	return st
+}
+
+func (n *Node) Close() {
+	n.cancel()
+	n.wg.Wait()
+}
@@ -0,0 +1,173 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pushBatch         = 500
+	heartbeatInterval = 5 * time.Second
+	maxRetryDelay     = 30 * time.Second
+)
+
+// pusher streams the update log of a primary to a single replica.
+type pusher struct {
+	url  string
+	node *Node
+	log  *updateLog
+
+	mu      sync.Mutex
+	acked   uint64
+	lastErr error
+}
+
+func (p *pusher) status() ReplicaStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := ReplicaStatus{URL: p.url, Acked: p.acked}
+	if p.lastErr != nil {
+		st.Error = p.lastErr.Error()
+	}
+	return st
+}
+
+func (p *pusher) record(acked uint64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.acked = acked
+	}
+	p.lastErr = err
+}
+
+func (p *pusher) run(ctx context.Context) {
+	delay := time.Second
+	known := false
+	var acked uint64
+
+	for ctx.Err() == nil {
+		var err error
+		seq, changed := p.log.current()
+		switch {
+		case !known:
+			acked, err = p.replicaSeq(ctx)
+		case acked == seq:
+			select {
+			case <-ctx.Done():
+			case <-changed:
+			case <-time.After(heartbeatInterval):
+				// Re-read the replica position to notice restarts while idle.
+				known = false
+			}
+			continue
+		default:
+			// A replica at seq 0 may hold state of its own, e.g. restored
+			// from a file, and replaying the log onto it would apply the
+			// same updates twice.
+			if entries, ok := p.log.since(acked, pushBatch); ok && acked > 0 {
+				acked, err = p.push(ctx, entries)
+			} else {
+				acked, err = p.sendSnapshot(ctx)
+			}
+		}
+
+		if errors.Is(err, errGap) {
+			// The replica told us where it is; the next round resends from
+			// there or falls back to a snapshot.
+			err = nil
+		}
+		p.record(acked, err)
+		if err == nil {
+			known = true
+			delay = time.Second
+			continue
+		}
+
+		known = false
+		if ctx.Err() == nil && p.node.cfg.OnError != nil {
+			p.node.cfg.OnError(p.url, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+func (p *pusher) replicaSeq(ctx context.Context) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint("/replication/status"), nil)
+	if err != nil {
+		return 0, err
+	}
+	var st Status
+	if err := p.do(req, &st); err != nil {
+		return 0, err
+	}
+	if st.Role != RoleReplica {
+		return 0, fmt.Errorf("%s is a %s", p.url, st.Role)
+	}
+	return st.Seq, nil
+}
+
+func (p *pusher) push(ctx context.Context, entries []Entry) (uint64, error) {
+	return p.post(ctx, "/replication/apply", applyRequest{Entries: entries})
+}
+
+func (p *pusher) sendSnapshot(ctx context.Context) (uint64, error) {
+	s, err := p.node.snapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return p.post(ctx, "/replication/snapshot", s)
+}
+
+func (p *pusher) post(ctx context.Context, path string, body any) (uint64, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint(path), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var res ack
+	err = p.do(req, &res)
+	return res.Seq, err
+}
+
+// do sends req and decodes the JSON response into out. A 409 Conflict still
+// carries the replica position and is reported as errGap.
+func (p *pusher) do(req *http.Request, out any) error {
+	resp, err := p.node.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusConflict:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return err
+		}
+		return errGap
+	default:
+		return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL, resp.Status)
+	}
+}
+
+func (p *pusher) endpoint(path string) string {
+	return strings.TrimSuffix(p.url, "/") + path
+}
@@ -0,0 +1,161 @@
+package replication
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startNode(t *testing.T, cfg Config) (*Node, string) {
+	t.Helper()
+	n := NewNode(storage.NewMemStorage(), cfg)
+	r := chi.NewRouter()
+	n.RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(func() {
+		n.Close()
+		srv.Close()
+	})
+	return n, srv.URL
+}
+
+func eventuallyHas(t *testing.T, n *Node, m models.Metrics) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		got, err := n.Get(context.Background(), m.MType, m.ID)
+		if err != nil {
+			return false
+		}
+		if m.MType == "gauge" {
+			return *got.Value == *m.Value
+		}
+		return *got.Delta == *m.Delta
+	}, 5*time.Second, 10*time.Millisecond, "%s %s not replicated", m.MType, m.ID)
+}
+
+func TestReplicationStreamsUpdates(t *testing.T) {
+	ctx := context.Background()
+	replica, replicaURL := startNode(t, Config{Role: RoleReplica})
+	primary, _ := startNode(t, Config{Role: RolePrimary, Replicas: []string{replicaURL}})
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, primary.Add(ctx, storagetest.Counter("PollCount", 1)))
+	}
+	require.NoError(t, primary.AddBatch(ctx, []models.Metrics{storagetest.Gauge("Alloc", 1), storagetest.Gauge("Alloc", 2)}))
+
+	eventuallyHas(t, replica, storagetest.Counter("PollCount", 10))
+	eventuallyHas(t, replica, storagetest.Gauge("Alloc", 2))
+	assert.Equal(t, uint64(11), replica.Status().Seq)
+
+	assert.ErrorIs(t, replica.Add(ctx, storagetest.Counter("PollCount", 1)), ErrReadOnly)
+	assert.ErrorIs(t, replica.Add(ctx, storagetest.Counter("PollCount", 1)), storage.ErrUnavailable)
+}
+
+func TestReplicationCatchesUpFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	primary := NewNode(storage.NewMemStorage(), Config{Role: RolePrimary, LogSize: 2})
+	for i := 0; i < 5; i++ {
+		require.NoError(t, primary.Add(ctx, storagetest.Counter("PollCount", 1)))
+	}
+
+	// The replica joins after the log has been truncated.
+	replica, replicaURL := startNode(t, Config{Role: RoleReplica})
+	primary.cfg.Replicas = []string{replicaURL}
+	primary.startPushers()
+	t.Cleanup(primary.Close)
+
+	eventuallyHas(t, replica, storagetest.Counter("PollCount", 5))
+
+	require.NoError(t, primary.Add(ctx, storagetest.Gauge("Alloc", 3)))
+	eventuallyHas(t, replica, storagetest.Gauge("Alloc", 3))
+	assert.Eventually(t, func() bool {
+		st := primary.Status()
+		return len(st.Replicas) == 1 && st.Replicas[0].Acked == 6
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicationSnapshotsReplicaAtZero(t *testing.T) {
+	ctx := context.Background()
+	// The replica already holds the values the primary has logged, e.g.
+	// restored from the same file, but reports seq 0.
+	replicaStore := storage.NewMemStorage()
+	require.NoError(t, replicaStore.Add(ctx, storagetest.Counter("PollCount", 3)))
+	replica := NewNode(replicaStore, Config{Role: RoleReplica})
+	r := chi.NewRouter()
+	replica.RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	primary := NewNode(storage.NewMemStorage(), Config{Role: RolePrimary})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, primary.Add(ctx, storagetest.Counter("PollCount", 1)))
+	}
+	primary.cfg.Replicas = []string{srv.URL}
+	primary.startPushers()
+	t.Cleanup(primary.Close)
+
+	assert.Eventually(t, func() bool { return replica.Status().Seq == 3 }, 5*time.Second, 10*time.Millisecond)
+	got, err := replica.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *got.Delta, "the log must not be replayed on top of existing state")
+}
+
+func TestReplicationSendsRestoredPrimaryState(t *testing.T) {
+	ctx := context.Background()
+	replica, replicaURL := startNode(t, Config{Role: RoleReplica})
+
+	store := storage.NewMemStorage()
+	require.NoError(t, store.Add(ctx, storagetest.Gauge("Alloc", 7)))
+	primary := NewNode(store, Config{Role: RolePrimary, Replicas: []string{replicaURL}})
+	t.Cleanup(primary.Close)
+
+	eventuallyHas(t, replica, storagetest.Gauge("Alloc", 7))
+}
+
+func TestPromote(t *testing.T) {
+	ctx := context.Background()
+	second, secondURL := startNode(t, Config{Role: RoleReplica})
+	first, _ := startNode(t, Config{Role: RoleReplica, Replicas: []string{secondURL}})
+
+	assert.ErrorIs(t, first.Add(ctx, storagetest.Counter("PollCount", 1)), ErrReadOnly)
+
+	first.Promote()
+	assert.Equal(t, RolePrimary, first.Status().Role)
+	require.NoError(t, first.Add(ctx, storagetest.Counter("PollCount", 1)))
+	eventuallyHas(t, second, storagetest.Counter("PollCount", 1))
+}
+
+func TestUpdateLogSince(t *testing.T) {
+	l := newUpdateLog(3, 0)
+	for i := 0; i < 5; i++ {
+		l.append([]models.Metrics{storagetest.Counter("PollCount", 1)})
+	}
+
+	entries, ok := l.since(2, 10)
+	require.True(t, ok)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(3), entries[0].Seq)
+
+	entries, ok = l.since(3, 1)
+	require.True(t, ok)
+	require.Len(t, entries, 1)
+	assert.Equal(t, uint64(4), entries[0].Seq)
+
+	_, ok = l.since(1, 10)
+	assert.False(t, ok, "entry 2 has been dropped")
+
+	entries, ok = l.since(5, 10)
+	assert.True(t, ok)
+	assert.Empty(t, entries)
+
+	_, ok = l.since(7, 10)
+	assert.False(t, ok, "a replica ahead of the primary needs a snapshot")
+}
@@ -0,0 +1,94 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errTransient = errors.New("transient")
+
+func TestBreakerTransitions(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	assert.NoError(t, b.Allow())
+	b.Record(true)
+	assert.Equal(t, Closed, b.State())
+
+	assert.NoError(t, b.Allow())
+	b.Record(true)
+	assert.Equal(t, Open, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, HalfOpen, b.State())
+	assert.NoError(t, b.Allow(), "one probe is let through after the cooldown")
+	assert.ErrorIs(t, b.Allow(), ErrOpen, "only one probe at a time")
+	b.Record(true)
+	assert.Equal(t, Open, b.State())
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Allow())
+	b.Record(false)
+	assert.Equal(t, Closed, b.State())
+	assert.NoError(t, b.Allow())
+}
+
+func TestPolicyRetries(t *testing.T) {
+	p := &Policy{
+		Delays:    []time.Duration{time.Millisecond, time.Millisecond},
+		Retriable: func(err error) bool { return errors.Is(err, errTransient) },
+	}
+
+	calls := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errors.New("permanent")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestPolicyStopsOnCancel(t *testing.T) {
+	p := &Policy{
+		Delays:    []time.Duration{time.Hour},
+		Retriable: func(err error) bool { return true },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := p.Do(ctx, func(ctx context.Context) error { return errTransient })
+	assert.ErrorIs(t, err, errTransient)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestPolicyOpensBreaker(t *testing.T) {
+	p := &Policy{
+		Breaker: NewBreaker(1, time.Hour),
+		Failure: func(err error) bool { return errors.Is(err, errTransient) },
+	}
+
+	assert.Error(t, p.Do(context.Background(), func(ctx context.Context) error { return errors.New("not found") }))
+	assert.Equal(t, Closed, p.Breaker.State(), "errors that are not failures keep the breaker closed")
+
+	assert.ErrorIs(t, p.Do(context.Background(), func(ctx context.Context) error { return errTransient }), errTransient)
+	assert.ErrorIs(t, p.Do(context.Background(), func(ctx context.Context) error { return nil }), ErrOpen)
+}
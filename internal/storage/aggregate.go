@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var aggregateFuncs = map[string]string{
+	"sum":   "SUM",
+	"avg":   "AVG",
+	"min":   "MIN",
+	"max":   "MAX",
+	"count": "COUNT",
+}
+
+// AggregateQuery folds the values of all metrics of one type whose names
+// match with Op: "sum", "avg", "min", "max" or "count".
+type AggregateQuery struct {
+	Op   string
+	Type string
+	// Glob matches whole names: * stands for any run of characters, including
+	// none, and ? for exactly one. It is ignored when Regex is set; leaving
+	// both empty matches every metric.
+	Glob  string
+	Regex *regexp.Regexp
+}
+
+// Aggregate is the result of an AggregateQuery. Value is nil when nothing
+// matched, except for sum and count, which are zero then.
+type Aggregate struct {
+	Count int64
+	Value *float64
+}
+
+// Aggregator computes aggregates without loading every matching metric.
+type Aggregator interface {
+	Aggregate(ctx context.Context, q AggregateQuery) (Aggregate, error)
+}
+
+func (q AggregateQuery) validate() error {
+	if q.Type != "gauge" && q.Type != "counter" {
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, q.Type)
+	}
+	if _, ok := aggregateFuncs[q.Op]; !ok {
+		return fmt.Errorf("%w: unknown aggregate %q", ErrInvalidValue, q.Op)
+	}
+	return nil
+}
+
+// AggregateMetrics runs q on repo, pushing it down when repo is an
+// Aggregator and folding the listed metrics otherwise. Wrapped repositories
+// are not searched for an Aggregator, since the wrapper may hold writes the
+// backend has not seen yet.
+func AggregateMetrics(ctx context.Context, repo Repository, q AggregateQuery) (Aggregate, error) {
+	if a, ok := repo.(Aggregator); ok {
+		return a.Aggregate(ctx, q)
+	}
+	return aggregateList(ctx, repo, q)
+}
+
+func aggregateList(ctx context.Context, repo Repository, q AggregateQuery) (Aggregate, error) {
+	if err := q.validate(); err != nil {
+		return Aggregate{}, err
+	}
+	opts := ListOptions{Type: q.Type, Regex: q.Regex}
+	if q.Regex == nil && q.Glob != "" {
+		opts.Prefix = globPrefix(q.Glob)
+		opts.Regex = globRegexp(q.Glob)
+	}
+	metrics, err := repo.List(ctx, opts)
+	if err != nil {
+		return Aggregate{}, err
+	}
+
+	var count int64
+	var acc float64
+	for _, m := range metrics {
+		var v float64
+		switch {
+		case m.Value != nil:
+			v = *m.Value
+		case m.Delta != nil:
+			v = float64(*m.Delta)
+		default:
+			continue
+		}
+		switch {
+		case count == 0:
+			acc = v
+		case q.Op == "sum", q.Op == "avg":
+			acc += v
+		case q.Op == "min":
+			acc = min(acc, v)
+		case q.Op == "max":
+			acc = max(acc, v)
+		}
+		count++
+	}
+	if q.Op == "avg" && count > 0 {
+		acc /= float64(count)
+	}
+	return newAggregate(q.Op, count, acc, count > 0), nil
+}
+
+func newAggregate(op string, count int64, value float64, valid bool) Aggregate {
+	switch op {
+	case "count":
+		value, valid = float64(count), true
+	case "sum":
+		valid = true
+	}
+	a := Aggregate{Count: count}
+	if valid {
+		a.Value = &value
+	}
+	return a
+}
+
+func globPrefix(glob string) string {
+	if i := strings.IndexAny(glob, "*?"); i >= 0 {
+		return glob[:i]
+	}
+	return glob
+}
+
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`)$`)
+	return regexp.MustCompile(b.String())
+}
+
+// globLike translates a glob into a LIKE pattern escaped with a backslash.
+func globLike(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func aggregateQuery(q AggregateQuery) (string, []any) {
+	table, column := "gauges", "value"
+	if q.Type == "counter" {
+		table, column = "counters", "delta"
+	}
+	query := fmt.Sprintf("SELECT COUNT(*), %s(%s)::double precision FROM %s", aggregateFuncs[q.Op], column, table)
+	if q.Glob == "" {
+		return query, nil
+	}
+	return query + ` WHERE name LIKE $1 ESCAPE '\'`, []any{globLike(q.Glob)}
+}
+
+// Aggregate pushes globs down to Postgres. Regular expressions are matched
+// in Go, because Postgres regex syntax differs from RE2.
+func (r *SQLRepo) Aggregate(ctx context.Context, q AggregateQuery) (Aggregate, error) {
+	if q.Regex != nil {
+		return aggregateList(ctx, r, q)
+	}
+	if err := q.validate(); err != nil {
+		return Aggregate{}, err
+	}
+
+	query, args := aggregateQuery(q)
+	var count int64
+	var value sql.NullFloat64
+	err := r.read(ctx, func(ctx context.Context, db *sql.DB) error {
+		return db.QueryRowContext(ctx, query, args...).Scan(&count, &value)
+	})
+	if err != nil {
+		return Aggregate{}, err
+	}
+	return newAggregate(q.Op, count, value.Float64, value.Valid), nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		glob    string
+		like    string
+		prefix  string
+		matches []string
+		misses  []string
+	}{
+		{glob: "*/HeapAlloc", like: "%/HeapAlloc", prefix: "", matches: []string{"dc1/HeapAlloc", "/HeapAlloc", "a/b/HeapAlloc"}, misses: []string{"HeapAlloc", "dc1/HeapAllocs"}},
+		{glob: "dc?/Heap*", like: "dc_/Heap%", prefix: "dc", matches: []string{"dc1/Heap", "dc2/HeapInuse"}, misses: []string{"dc10/Heap"}},
+		{glob: `a%b_c\d.e`, like: `a\%b\_c\\d.e`, prefix: `a%b_c\d.e`, matches: []string{`a%b_c\d.e`}, misses: []string{`axb_c\d.e`, `a%b_c\dxe`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			assert.Equal(t, tt.like, globLike(tt.glob))
+			assert.Equal(t, tt.prefix, globPrefix(tt.glob))
+			re := globRegexp(tt.glob)
+			for _, name := range tt.matches {
+				assert.True(t, re.MatchString(name), name)
+			}
+			for _, name := range tt.misses {
+				assert.False(t, re.MatchString(name), name)
+			}
+		})
+	}
+}
+
+func TestAggregateQuery(t *testing.T) {
+	query, args := aggregateQuery(AggregateQuery{Op: "avg", Type: "counter", Glob: "dc?/*"})
+	assert.Equal(t, `SELECT COUNT(*), AVG(delta)::double precision FROM counters WHERE name LIKE $1 ESCAPE '\'`, query)
+	assert.Equal(t, []any{"dc_/%"}, args)
+
+	query, args = aggregateQuery(AggregateQuery{Op: "max", Type: "gauge"})
+	assert.Equal(t, "SELECT COUNT(*), MAX(value)::double precision FROM gauges", query)
+	assert.Empty(t, args)
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+const flushTimeout = 10 * time.Second
+
+type CacheConfig struct {
+	// FlushInterval enables write-behind mode when positive: writes are
+	// applied to the cache immediately and sent to the backend in batches.
+	// Zero means write-through.
+	FlushInterval time.Duration
+	OnFlushError  func(err error)
+}
+
+type CachedRepo struct {
+	backend Repository
+	cache   *MemStorage
+	cfg     CacheConfig
+
+	// syncMu is held for reading while a write is on its way to the backend
+	// and for writing while the cache is refreshed from the backend, so that a
+	// refresh never observes a write the cache has not applied yet or vice versa.
+	syncMu sync.RWMutex
+	// writeMu orders write-through writes to the same key, by the key's
+	// cache shard, so that the backend and the cache apply them in the same
+	// order and end up with the same gauge value.
+	writeMu [shardCount]sync.Mutex
+
+	mu              sync.Mutex
+	pendingGauges   map[string]float64
+	pendingCounters map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewCachedRepo(ctx context.Context, backend Repository, cfg CacheConfig) (*CachedRepo, error) {
+	c := &CachedRepo{
+		backend:         backend,
+		cache:           NewMemStorage(),
+		cfg:             cfg,
+		pendingGauges:   make(map[string]float64),
+		pendingCounters: make(map[string]int64),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	metrics, err := backend.GetAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to warm up cache: %w", err)
+	}
+	for _, m := range metrics {
+		c.cache.set(m)
+	}
+
+	if cfg.FlushInterval > 0 {
+		go c.flushLoop()
+	} else {
+		close(c.done)
+	}
+	return c, nil
+}
+
+func (c *CachedRepo) Add(ctx context.Context, m models.Metrics) error {
+	if err := Validate(m); err != nil {
+		return err
+	}
+	if c.cfg.FlushInterval > 0 {
+		return c.enqueue(ctx, []models.Metrics{m})
+	}
+	c.syncMu.RLock()
+	defer c.syncMu.RUnlock()
+	defer c.lockKeys([]models.Metrics{m})()
+	if err := c.backend.Add(ctx, m); err != nil {
+		return err
+	}
+	return c.cache.Add(ctx, m)
+}
+
+func (c *CachedRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := Validate(m); err != nil {
+			return err
+		}
+	}
+	if c.cfg.FlushInterval > 0 {
+		return c.enqueue(ctx, metrics)
+	}
+	c.syncMu.RLock()
+	defer c.syncMu.RUnlock()
+	defer c.lockKeys(metrics)()
+	if err := c.backend.AddBatch(ctx, metrics); err != nil {
+		return err
+	}
+	return c.cache.AddBatch(ctx, metrics)
+}
+
+// lockKeys locks the write stripes of metrics in index order and returns a
+// function that unlocks them.
+func (c *CachedRepo) lockKeys(metrics []models.Metrics) func() {
+	var locked [shardCount]bool
+	for _, m := range metrics {
+		locked[c.cache.shardIndex(m.ID)] = true
+	}
+	for i := range c.writeMu {
+		if locked[i] {
+			c.writeMu[i].Lock()
+		}
+	}
+	return func() {
+		for i := range c.writeMu {
+			if locked[i] {
+				c.writeMu[i].Unlock()
+			}
+		}
+	}
+}
+
+func (c *CachedRepo) enqueue(ctx context.Context, metrics []models.Metrics) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.cache.AddBatch(ctx, metrics); err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		switch m.MType {
+		case "gauge":
+			c.pendingGauges[m.ID] = *m.Value
+		case "counter":
+			c.pendingCounters[m.ID] += *m.Delta
+		}
+	}
+	return nil
+}
+
+func (c *CachedRepo) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	return c.cache.Get(ctx, metricType, name)
+}
+
+// GetVersioned serves versions of the cache, which change whenever the
+// cached value does.
+func (c *CachedRepo) GetVersioned(ctx context.Context, metricType, name string) (models.Metrics, int64, error) {
+	return c.cache.GetVersioned(ctx, metricType, name)
+}
+
+func (c *CachedRepo) GetAll(ctx context.Context) ([]models.Metrics, error) {
+	return c.cache.GetAll(ctx)
+}
+
+func (c *CachedRepo) Ping(ctx context.Context) error {
+	return c.backend.Ping(ctx)
+}
+
+func (c *CachedRepo) Unwrap() Repository {
+	return c.backend
+}
+
+// Refresh reloads the named metrics from the backend, e.g. after another
+// instance changed them. Local writes not flushed yet are kept on top.
+func (c *CachedRepo) Refresh(ctx context.Context, gauges, counters []string) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	var metrics []models.Metrics
+	for _, names := range []struct {
+		mtype string
+		ids   []string
+	}{{"gauge", gauges}, {"counter", counters}} {
+		for _, name := range names.ids {
+			m, err := c.backend.Get(ctx, names.mtype, name)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to refresh %s %s: %w", names.mtype, name, err)
+			}
+			metrics = append(metrics, m)
+		}
+	}
+	c.apply(metrics)
+	return nil
+}
+
+func (c *CachedRepo) RefreshAll(ctx context.Context) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	metrics, err := c.backend.GetAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to refresh cache: %w", err)
+	}
+	c.apply(metrics)
+	return nil
+}
+
+func (c *CachedRepo) apply(metrics []models.Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range metrics {
+		switch m.MType {
+		case "gauge":
+			if _, ok := c.pendingGauges[m.ID]; ok {
+				continue
+			}
+		case "counter":
+			d := *m.Delta + c.pendingCounters[m.ID]
+			m.Delta = &d
+		}
+		c.cache.set(m)
+	}
+}
+
+func (c *CachedRepo) Flush(ctx context.Context) error {
+	c.syncMu.RLock()
+	defer c.syncMu.RUnlock()
+
+	c.mu.Lock()
+	gauges, counters := c.pendingGauges, c.pendingCounters
+	c.pendingGauges = make(map[string]float64)
+	c.pendingCounters = make(map[string]int64)
+	c.mu.Unlock()
+
+	if len(gauges) == 0 && len(counters) == 0 {
+		return nil
+	}
+
+	batch := make([]models.Metrics, 0, len(gauges)+len(counters))
+	for name, v := range gauges {
+		batch = append(batch, models.Metrics{ID: name, MType: "gauge", Value: &v})
+	}
+	for name, d := range counters {
+		batch = append(batch, models.Metrics{ID: name, MType: "counter", Delta: &d})
+	}
+
+	if err := c.backend.AddBatch(ctx, batch); err != nil {
+		// After an ambiguous commit the batch may have been applied, and
+		// resending the deltas could count them twice. Gauges are retried.
+		ambiguous := errors.Is(err, ErrAmbiguousCommit)
+		c.mu.Lock()
+		for name, v := range gauges {
+			if _, ok := c.pendingGauges[name]; !ok {
+				c.pendingGauges[name] = v
+			}
+		}
+		if !ambiguous {
+			for name, d := range counters {
+				c.pendingCounters[name] += d
+			}
+		}
+		c.mu.Unlock()
+		if ambiguous && len(counters) > 0 {
+			return fmt.Errorf("failed to flush cache, dropped %d counter deltas: %w", len(counters), err)
+		}
+		return fmt.Errorf("failed to flush cache: %w", err)
+	}
+	return nil
+}
+
+func (c *CachedRepo) Close(ctx context.Context) error {
+	if c.cfg.FlushInterval > 0 {
+		close(c.stop)
+		<-c.done
+	}
+	return c.Flush(ctx)
+}
+
+func (c *CachedRepo) flushLoop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			if err := c.Flush(ctx); err != nil && c.cfg.OnFlushError != nil {
+				c.cfg.OnFlushError(err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingRepo struct {
+	*MemStorage
+	fail bool
+}
+
+func (r *failingRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	if r.fail {
+		return ErrUnavailable
+	}
+	return r.MemStorage.AddBatch(ctx, metrics)
+}
+
+func TestCachedRepoWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	backend := &failingRepo{MemStorage: NewMemStorage()}
+	v, d := 1.5, int64(10)
+	require.NoError(t, backend.Add(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}))
+
+	repo, err := NewCachedRepo(ctx, backend, CacheConfig{FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	m, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err, "cache must be warmed up from the backend")
+	assert.Equal(t, int64(10), *m.Delta)
+
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}))
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}))
+
+	m, err = repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), *m.Delta)
+
+	_, err = backend.Get(ctx, "gauge", "Alloc")
+	assert.ErrorIs(t, err, ErrNotFound, "write-behind must not hit the backend before a flush")
+
+	backend.fail = true
+	assert.True(t, errors.Is(repo.Flush(ctx), ErrUnavailable))
+
+	backend.fail = false
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}))
+	require.NoError(t, repo.Close(ctx))
+
+	m, err = backend.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), *m.Delta, "failed flushes must be retried")
+
+	m, err = backend.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+}
+
+// slowAckRepo applies a write right away but holds back its reply until
+// release is closed, like a DB whose acknowledgement is delayed.
+type slowAckRepo struct {
+	*MemStorage
+	applied chan struct{}
+	release chan struct{}
+}
+
+func (r *slowAckRepo) Add(ctx context.Context, m models.Metrics) error {
+	if err := r.MemStorage.Add(ctx, m); err != nil {
+		return err
+	}
+	if *m.Value == 1 {
+		close(r.applied)
+		<-r.release
+	}
+	return nil
+}
+
+func TestCachedRepoWriteThroughOrder(t *testing.T) {
+	ctx := context.Background()
+	backend := &slowAckRepo{MemStorage: NewMemStorage(), applied: make(chan struct{}), release: make(chan struct{})}
+	repo, err := NewCachedRepo(ctx, backend, CacheConfig{})
+	require.NoError(t, err)
+
+	v1, v2 := 1.0, 2.0
+	first := make(chan error)
+	go func() { first <- repo.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &v1}) }()
+	<-backend.applied
+	second := make(chan error)
+	go func() { second <- repo.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &v2}) }()
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+
+	cached, err := repo.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	stored, err := backend.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, *stored.Value, *cached.Value, "cache and backend must agree on the last write")
+}
+
+// ambiguousRepo applies the first batch and then reports that the commit
+// outcome is unknown, like a DB whose connection broke after COMMIT.
+type ambiguousRepo struct {
+	*MemStorage
+	failed bool
+}
+
+func (r *ambiguousRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	if err := r.MemStorage.AddBatch(ctx, metrics); err != nil {
+		return err
+	}
+	if !r.failed {
+		r.failed = true
+		return fmt.Errorf("%w: %w", ErrUnavailable, ErrAmbiguousCommit)
+	}
+	return nil
+}
+
+func TestCachedRepoFlushAfterAmbiguousCommit(t *testing.T) {
+	ctx := context.Background()
+	backend := &ambiguousRepo{MemStorage: NewMemStorage()}
+	repo, err := NewCachedRepo(ctx, backend, CacheConfig{FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	d, v := int64(5), 1.0
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}))
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}))
+	assert.ErrorIs(t, repo.Flush(ctx), ErrAmbiguousCommit)
+	require.NoError(t, repo.Close(ctx))
+
+	m, err := backend.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *m.Delta, "counter deltas must not be applied twice")
+	m, err = repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *m.Delta)
+	assert.Empty(t, repo.pendingGauges, "gauges are retried")
+}
+
+func TestCachedRepoRefresh(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemStorage()
+	repo, err := NewCachedRepo(ctx, backend, CacheConfig{FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	local, remote := int64(5), int64(100)
+	v1, v2 := 1.0, 2.0
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &local}))
+	require.NoError(t, repo.Add(ctx, models.Metrics{ID: "Local", MType: "gauge", Value: &v1}))
+
+	// Writes made by another instance sharing the backend.
+	require.NoError(t, backend.AddBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &remote},
+		{ID: "Local", MType: "gauge", Value: &v2},
+		{ID: "Remote", MType: "gauge", Value: &v2},
+	}))
+
+	require.NoError(t, repo.Refresh(ctx, []string{"Local", "Remote", "Missing"}, []string{"PollCount"}))
+
+	m, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(105), *m.Delta, "unflushed deltas are kept on top of the backend value")
+
+	m, err = repo.Get(ctx, "gauge", "Local")
+	require.NoError(t, err)
+	assert.Equal(t, v1, *m.Value, "unflushed gauges win over the backend value")
+
+	m, err = repo.Get(ctx, "gauge", "Remote")
+	require.NoError(t, err)
+	assert.Equal(t, v2, *m.Value)
+
+	require.NoError(t, repo.Close(ctx))
+	require.NoError(t, repo.RefreshAll(ctx))
+	m, err = repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(105), *m.Delta)
+}
+
+func TestChangePayload(t *testing.T) {
+	payload, err := changePayload("a", []batchGauge{{name: "Alloc"}}, []batchCounter{{name: "PollCount"}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"source":"a","gauges":["Alloc"],"counters":["PollCount"]}`, payload)
+
+	many := make([]batchGauge, 1000)
+	for i := range many {
+		many[i].name = fmt.Sprintf("metric%d", i)
+	}
+	payload, err = changePayload("a", many, nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"source":"a","all":true}`, payload)
+}
@@ -0,0 +1,59 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosta324/metrics.git/internal/db"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/kosta324/metrics.git/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return storage.NewMemStorage()
+	})
+}
+
+func TestSQLiteRepoConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		repo, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "metrics.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
+
+func TestSQLRepoConformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set, skipping Postgres conformance tests")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		repo, err := storage.NewSQLStorage(context.Background(), db.DefaultConfig(dsn))
+		require.NoError(t, err)
+		t.Cleanup(func() { repo.Close() })
+		_, err = repo.DB().ExecContext(context.Background(), "TRUNCATE gauges, counters")
+		require.NoError(t, err)
+		return repo
+	})
+}
+
+func TestCachedRepoConformance(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Hour} {
+		t.Run(interval.String(), func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.Repository {
+				repo, err := storage.NewCachedRepo(context.Background(), storage.NewMemStorage(),
+					storage.CacheConfig{FlushInterval: interval})
+				require.NoError(t, err)
+				t.Cleanup(func() { repo.Close(context.Background()) })
+				return repo
+			})
+		})
+	}
+}
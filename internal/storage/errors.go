@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrNotFound        = errors.New("metric not found")
+	ErrUnsupportedType = errors.New("unsupported metric type")
+	ErrInvalidValue    = errors.New("invalid metric value")
+	ErrUnavailable     = errors.New("storage unavailable")
+	// ErrOverloaded means a write was refused to shed load and may be retried
+	// later.
+	ErrOverloaded = errors.New("storage overloaded")
+	// ErrAmbiguousCommit means the connection broke while committing, so the
+	// write may or may not have been applied. Only idempotent writes such as
+	// gauges may be repeated after it.
+	ErrAmbiguousCommit = errors.New("commit outcome unknown")
+)
+
+func wrapDBError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if isUnavailable(err) {
+		if errors.Is(err, ErrAmbiguousCommit) {
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+func isUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) || isConnectionPgError(err) {
+		return true
+	}
+	var connErr *pgconn.ConnectError
+	if errors.As(err, &connErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
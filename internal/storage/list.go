@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kosta324/metrics.git/internal/models"
+)
+
+// ListOptions selects a page of metrics ordered by ID, then type.
+type ListOptions struct {
+	// Type restricts the result to "gauge" or "counter" when set.
+	Type   string
+	Prefix string
+	Regex  *regexp.Regexp
+	// AfterID and AfterType form the cursor: only metrics ordered after this
+	// pair are returned.
+	AfterID   string
+	AfterType string
+	// Limit caps the number of returned metrics; zero means no limit.
+	Limit int
+}
+
+func (o ListOptions) match(m models.Metrics) bool {
+	if o.Type != "" && m.MType != o.Type {
+		return false
+	}
+	if !strings.HasPrefix(m.ID, o.Prefix) {
+		return false
+	}
+	if o.AfterID != "" || o.AfterType != "" {
+		if m.ID < o.AfterID || (m.ID == o.AfterID && m.MType <= o.AfterType) {
+			return false
+		}
+	}
+	return o.Regex == nil || o.Regex.MatchString(m.ID)
+}
+
+func lessMetrics(a, b models.Metrics) bool {
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return a.MType < b.MType
+}
+
+// SortMetrics orders metrics the way List returns them.
+func SortMetrics(metrics []models.Metrics) {
+	sort.Slice(metrics, func(i, j int) bool { return lessMetrics(metrics[i], metrics[j]) })
+}
+
+func (ms *MemStorage) List(ctx context.Context, opts ListOptions) ([]models.Metrics, error) {
+	all, err := ms.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := all[:0]
+	for _, m := range all {
+		if opts.match(m) {
+			result = append(result, m)
+		}
+	}
+	SortMetrics(result)
+	if opts.Limit > 0 && len(result) > opts.Limit {
+		result = result[:opts.Limit]
+	}
+	return result, nil
+}
+
+// listQuery builds a query returning metrics in List order with every filter
+// except the regular expression pushed down. The regular expression is
+// applied while scanning so that all backends share Go regexp syntax, which
+// also means LIMIT can only be pushed down without one. collate forces byte
+// order so that pages line up with the cursor comparison.
+func listQuery(opts ListOptions, collate string) (string, []any) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if opts.Type != "" {
+		where = append(where, "type = "+arg(opts.Type))
+	}
+	if opts.Prefix != "" {
+		p := arg(opts.Prefix)
+		where = append(where, fmt.Sprintf("substr(name, 1, length(%s)) = %s", p, p))
+	}
+	if opts.AfterID != "" || opts.AfterType != "" {
+		where = append(where, fmt.Sprintf("(name %s, type) > (%s, %s)", collate, arg(opts.AfterID), arg(opts.AfterType)))
+	}
+
+	query := `SELECT name, type, value, delta FROM (
+		SELECT name, 'gauge' AS type, value, NULL AS delta FROM gauges
+		UNION ALL
+		SELECT name, 'counter' AS type, NULL AS value, delta FROM counters
+	) m`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY name %s, type", collate)
+	if opts.Limit > 0 && opts.Regex == nil {
+		query += " LIMIT " + arg(opts.Limit)
+	}
+	return query, args
+}
+
+func list(ctx context.Context, db *sql.DB, opts ListOptions, collate string) ([]models.Metrics, error) {
+	query, args := listQuery(opts, collate)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	defer rows.Close()
+
+	result := []models.Metrics{}
+	for rows.Next() {
+		var m models.Metrics
+		if err := rows.Scan(&m.ID, &m.MType, &m.Value, &m.Delta); err != nil {
+			return nil, fmt.Errorf("failed to scan metric: %w", err)
+		}
+		if opts.Regex != nil && !opts.Regex.MatchString(m.ID) {
+			continue
+		}
+		result = append(result, m)
+		if opts.Limit > 0 && len(result) == opts.Limit {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading metrics: %w", err)
+	}
+	return result, nil
+}
+
+func (r *SQLRepo) List(ctx context.Context, opts ListOptions) ([]models.Metrics, error) {
+	var result []models.Metrics
+	err := r.read(ctx, func(ctx context.Context, db *sql.DB) error {
+		var err error
+		result, err = list(ctx, db, opts, `COLLATE "C"`)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *SQLiteRepo) List(ctx context.Context, opts ListOptions) ([]models.Metrics, error) {
+	result, err := list(ctx, r.db, opts, "COLLATE BINARY")
+	if err != nil {
+		return nil, wrapDBError(err)
+	}
+	return result, nil
+}
+
+func (c *CachedRepo) List(ctx context.Context, opts ListOptions) ([]models.Metrics, error) {
+	return c.cache.List(ctx, opts)
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+
+	"github.com/kosta324/metrics.git/internal/migrate"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+func NewPostgresMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	sub, err := fs.Sub(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, sub, migrate.Postgres)
+}
+
+func NewSQLiteMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	sub, err := fs.Sub(sqliteMigrations, "migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, sub, migrate.SQLite)
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS gauges (
+    name TEXT PRIMARY KEY,
+    value DOUBLE PRECISION
+);
+
+CREATE TABLE IF NOT EXISTS counters (
+    name TEXT PRIMARY KEY,
+    delta BIGINT
+);
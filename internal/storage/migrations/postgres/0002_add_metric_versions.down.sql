@@ -0,0 +1,3 @@
+ALTER TABLE gauges DROP COLUMN IF EXISTS version;
+
+ALTER TABLE counters DROP COLUMN IF EXISTS version;
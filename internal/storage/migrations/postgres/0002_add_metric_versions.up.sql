@@ -0,0 +1,3 @@
+ALTER TABLE gauges ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+ALTER TABLE counters ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
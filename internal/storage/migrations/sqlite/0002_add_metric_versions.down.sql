@@ -0,0 +1,3 @@
+ALTER TABLE gauges DROP COLUMN version;
+
+ALTER TABLE counters DROP COLUMN version;
@@ -0,0 +1,3 @@
+ALTER TABLE gauges ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE counters ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
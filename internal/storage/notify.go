@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/kosta324/metrics.git/internal/db"
+)
+
+const ChangesChannel = "metrics_changed"
+
+// Postgres rejects notification payloads of 8000 bytes or more.
+const maxChangePayload = 7900
+
+// Change is the payload of a ChangesChannel notification.
+type Change struct {
+	Source   string   `json:"source"`
+	Gauges   []string `json:"gauges,omitempty"`
+	Counters []string `json:"counters,omitempty"`
+	// All replaces the name lists when they do not fit into one payload.
+	All bool `json:"all,omitempty"`
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func changePayload(source string, gauges []batchGauge, counters []batchCounter) (string, error) {
+	change := Change{Source: source}
+	for _, g := range gauges {
+		change.Gauges = append(change.Gauges, g.name)
+	}
+	for _, c := range counters {
+		change.Counters = append(change.Counters, c.name)
+	}
+
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) > maxChangePayload {
+		payload, err = json.Marshal(Change{Source: source, All: true})
+	}
+	return string(payload), err
+}
+
+func notifyChange(ctx context.Context, db execer, source string, gauges []batchGauge, counters []batchCounter) error {
+	payload, err := changePayload(source, gauges, counters)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "SELECT pg_notify($1, $2)", ChangesChannel, payload)
+	return err
+}
+
+// WatchChanges keeps cache coherent with writes made through other SQLRepo
+// instances sharing the same database until ctx is done. Notifications sent by
+// repo itself are ignored because cache already applied those writes.
+func WatchChanges(ctx context.Context, cfg db.Config, repo *SQLRepo, cache *CachedRepo, onError func(err error)) {
+	// Notifications are delivered on commit, before a replica may have
+	// replayed the change.
+	ctx = withPrimaryReads(ctx)
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	listener := &db.Listener{
+		Config:  cfg,
+		Channel: ChangesChannel,
+		OnConnect: func() {
+			report(cache.RefreshAll(ctx))
+		},
+		OnNotify: func(payload string) {
+			var change Change
+			if err := json.Unmarshal([]byte(payload), &change); err != nil {
+				report(fmt.Errorf("invalid change notification: %w", err))
+				return
+			}
+			if change.Source == repo.instanceID {
+				return
+			}
+			if change.All {
+				report(cache.RefreshAll(ctx))
+				return
+			}
+			report(cache.Refresh(ctx, change.Gauges, change.Counters))
+		},
+		OnError: func(err error) {
+			if !errors.Is(err, context.Canceled) {
+				report(fmt.Errorf("change listener: %w", err))
+			}
+		},
+	}
+	listener.Run(ctx)
+}
@@ -1,19 +1,61 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/maphash"
+	"math"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+
+	"github.com/kosta324/metrics.git/internal/models"
 )
 
 type Repository interface {
-	Add(metricType, name, value string) error
-	Get(metricType, name string) (string, error)
-	GetAll() map[string]string
-	Ping() error
+	Add(ctx context.Context, m models.Metrics) error
+	AddBatch(ctx context.Context, metrics []models.Metrics) error
+	Get(ctx context.Context, metricType, name string) (models.Metrics, error)
+	GetAll(ctx context.Context) ([]models.Metrics, error)
+	List(ctx context.Context, opts ListOptions) ([]models.Metrics, error)
+	Ping(ctx context.Context) error
+}
+
+type BreakerStater interface {
+	BreakerState() string
+}
+
+// Versioner reads a metric together with a version that grows with every
+// write to it. Versions start at 1; a missing metric yields ErrNotFound.
+type Versioner interface {
+	GetVersioned(ctx context.Context, metricType, name string) (models.Metrics, int64, error)
+}
+
+// Deferrer is implemented by repositories that accept writes before applying
+// them, so a read right after a write may not observe it.
+type Deferrer interface {
+	DefersWrites() bool
+}
+
+// DefersWrites reports whether repo or any repository it wraps defers writes.
+func DefersWrites(repo Repository) bool {
+	for repo != nil {
+		if d, ok := repo.(Deferrer); ok && d.DefersWrites() {
+			return true
+		}
+		repo = Unwrap(repo)
+	}
+	return false
+}
+
+func Unwrap(repo Repository) Repository {
+	if w, ok := repo.(interface{ Unwrap() Repository }); ok {
+		return w.Unwrap()
+	}
+	return nil
 }
 
 type FileBackedRepository interface {
@@ -23,81 +65,243 @@ type FileBackedRepository interface {
 	SetFilePath(path string)
 }
 
-type gauge float64
-type counter int64
+const shardCount = 64
 
-type MemStorage struct {
+type shard struct {
 	mu       sync.RWMutex
-	Gauges   map[string]gauge
-	Counters map[string]counter
+	gauges   map[string]*gaugeEntry
+	counters map[string]*counterEntry
+}
+
+// Entries bump their version after storing the value, so a reader that sees
+// a version also sees a value at least that new.
+type gaugeEntry struct {
+	bits    atomic.Uint64
+	version atomic.Int64
+}
+
+type counterEntry struct {
+	delta   atomic.Int64
+	version atomic.Int64
+}
+
+type MemStorage struct {
+	seed     maphash.Seed
+	shards   [shardCount]shard
+	saveMu   sync.Mutex
 	filePath string
 }
 
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		Gauges:   make(map[string]gauge),
-		Counters: make(map[string]counter),
+	ms := &MemStorage{seed: maphash.MakeSeed()}
+	for i := range ms.shards {
+		ms.shards[i].gauges = make(map[string]*gaugeEntry)
+		ms.shards[i].counters = make(map[string]*counterEntry)
 	}
+	return ms
 }
 
-func (ms *MemStorage) Add(metricType, name, value string) error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+func (ms *MemStorage) shardIndex(name string) int {
+	return int(maphash.String(ms.seed, name) % shardCount)
+}
 
-	switch metricType {
+func Validate(m models.Metrics) error {
+	switch m.MType {
 	case "gauge":
-		val, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return err
+		if m.Value == nil {
+			return fmt.Errorf("%w: missing gauge value for metric %s", ErrInvalidValue, m.ID)
 		}
-		ms.Gauges[name] = gauge(val)
 	case "counter":
-		val, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return err
+		if m.Delta == nil {
+			return fmt.Errorf("%w: missing counter delta for metric %s", ErrInvalidValue, m.ID)
 		}
-		ms.Counters[name] += counter(val)
 	default:
-		return errors.New("unsupported metric type")
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, m.MType)
+	}
+	return nil
+}
+
+func (ms *MemStorage) Add(ctx context.Context, m models.Metrics) error {
+	if err := Validate(m); err != nil {
+		return err
+	}
+
+	sh := &ms.shards[ms.shardIndex(m.ID)]
+
+	sh.mu.RLock()
+	applied := sh.tryAdd(m)
+	sh.mu.RUnlock()
+	if applied {
+		return nil
 	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.add(m)
 	return nil
 }
 
-func (ms *MemStorage) Get(metricType, name string) (string, error) {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
+func (ms *MemStorage) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := Validate(m); err != nil {
+			return err
+		}
+	}
+
+	var locked [shardCount]bool
+	for _, m := range metrics {
+		locked[ms.shardIndex(m.ID)] = true
+	}
+	for i := range ms.shards {
+		if locked[i] {
+			ms.shards[i].mu.Lock()
+		}
+	}
+	defer func() {
+		for i := range ms.shards {
+			if locked[i] {
+				ms.shards[i].mu.Unlock()
+			}
+		}
+	}()
+
+	for _, m := range metrics {
+		ms.shards[ms.shardIndex(m.ID)].add(m)
+	}
+	return nil
+}
+
+// tryAdd updates an existing entry in place and must be called under at least
+// a read lock. It reports false when the entry has to be created first.
+func (sh *shard) tryAdd(m models.Metrics) bool {
+	switch m.MType {
+	case "gauge":
+		if e, ok := sh.gauges[m.ID]; ok {
+			e.bits.Store(math.Float64bits(*m.Value))
+			e.version.Add(1)
+			return true
+		}
+	case "counter":
+		if e, ok := sh.counters[m.ID]; ok {
+			e.delta.Add(*m.Delta)
+			e.version.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+func (sh *shard) add(m models.Metrics) {
+	if sh.tryAdd(m) {
+		return
+	}
+	sh.set(m)
+}
+
+func (sh *shard) set(m models.Metrics) {
+	switch m.MType {
+	case "gauge":
+		e, ok := sh.gauges[m.ID]
+		if !ok {
+			e = new(gaugeEntry)
+			sh.gauges[m.ID] = e
+		}
+		e.bits.Store(math.Float64bits(*m.Value))
+		e.version.Add(1)
+	case "counter":
+		e, ok := sh.counters[m.ID]
+		if !ok {
+			e = new(counterEntry)
+			sh.counters[m.ID] = e
+		}
+		e.delta.Store(*m.Delta)
+		e.version.Add(1)
+	}
+}
+
+func (ms *MemStorage) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	sh := &ms.shards[ms.shardIndex(name)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
+	m := models.Metrics{ID: name, MType: metricType}
 	switch metricType {
 	case "gauge":
-		val, ok := ms.Gauges[name]
+		e, ok := sh.gauges[name]
 		if !ok {
-			return "", errors.New("not found")
+			return models.Metrics{}, ErrNotFound
 		}
-		return strconv.FormatFloat(float64(val), 'f', -1, 64), nil
+		v := math.Float64frombits(e.bits.Load())
+		m.Value = &v
 	case "counter":
-		val, ok := ms.Counters[name]
+		e, ok := sh.counters[name]
 		if !ok {
-			return "", errors.New("not found")
+			return models.Metrics{}, ErrNotFound
 		}
-		return fmt.Sprintf("%d", val), nil
+		d := e.delta.Load()
+		m.Delta = &d
 	default:
-		return "", errors.New("unsupported metric type")
+		return models.Metrics{}, fmt.Errorf("%w: %s", ErrUnsupportedType, metricType)
 	}
+	return m, nil
 }
 
-func (ms *MemStorage) GetAll() map[string]string {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
+func (ms *MemStorage) GetVersioned(ctx context.Context, metricType, name string) (models.Metrics, int64, error) {
+	sh := &ms.shards[ms.shardIndex(name)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	result := make(map[string]string)
+	// The version is loaded first, so the value is at least as new.
+	m := models.Metrics{ID: name, MType: metricType}
+	var version int64
+	switch metricType {
+	case "gauge":
+		e, ok := sh.gauges[name]
+		if !ok {
+			return models.Metrics{}, 0, ErrNotFound
+		}
+		version = e.version.Load()
+		v := math.Float64frombits(e.bits.Load())
+		m.Value = &v
+	case "counter":
+		e, ok := sh.counters[name]
+		if !ok {
+			return models.Metrics{}, 0, ErrNotFound
+		}
+		version = e.version.Load()
+		d := e.delta.Load()
+		m.Delta = &d
+	default:
+		return models.Metrics{}, 0, fmt.Errorf("%w: %s", ErrUnsupportedType, metricType)
+	}
+	return m, version, nil
+}
 
-	for k, v := range ms.Gauges {
-		result[k] = strconv.FormatFloat(float64(v), 'f', -1, 64)
+// GetAll holds every shard's read lock, taken in index order like AddBatch
+// does, so the snapshot never includes only part of a batch.
+func (ms *MemStorage) GetAll(ctx context.Context) ([]models.Metrics, error) {
+	for i := range ms.shards {
+		ms.shards[i].mu.RLock()
 	}
-	for k, v := range ms.Counters {
-		result[k] = fmt.Sprintf("%d", v)
+	defer func() {
+		for i := range ms.shards {
+			ms.shards[i].mu.RUnlock()
+		}
+	}()
+
+	var result []models.Metrics
+	for i := range ms.shards {
+		sh := &ms.shards[i]
+		for k, e := range sh.gauges {
+			v := math.Float64frombits(e.bits.Load())
+			result = append(result, models.Metrics{ID: k, MType: "gauge", Value: &v})
+		}
+		for k, e := range sh.counters {
+			d := e.delta.Load()
+			result = append(result, models.Metrics{ID: k, MType: "counter", Delta: &d})
+		}
 	}
-	return result
+	return result, nil
 }
 
 func (ms *MemStorage) SetFilePath(path string) {
@@ -105,37 +309,51 @@ func (ms *MemStorage) SetFilePath(path string) {
 }
 
 func (ms *MemStorage) SaveToFile() error {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
-
 	if ms.filePath == "" {
 		return errors.New("file path not set")
 	}
+
+	// The snapshot is taken under saveMu too, so that a slower concurrent
+	// save cannot replace the file with older values.
+	ms.saveMu.Lock()
+	defer ms.saveMu.Unlock()
+
+	metrics, err := ms.GetAll(context.Background())
+	if err != nil {
+		return err
+	}
 	data := map[string]map[string]string{
 		"gauges":   {},
 		"counters": {},
 	}
-	for k, v := range ms.Gauges {
-		data["gauges"][k] = strconv.FormatFloat(float64(v), 'f', -1, 64)
-	}
-	for k, v := range ms.Counters {
-		data["counters"][k] = fmt.Sprintf("%d", v)
+	for _, m := range metrics {
+		if m.MType == "gauge" {
+			data["gauges"][m.ID] = m.ValueString()
+		} else {
+			data["counters"][m.ID] = m.ValueString()
+		}
 	}
+	return writeFile(ms.filePath, data)
+}
 
-	file, err := os.Create(ms.filePath)
+// writeFile replaces path atomically with data encoded as JSON.
+func writeFile(path string, data map[string]map[string]string) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	enc := json.NewEncoder(file)
-	return enc.Encode(data)
+	if err := json.NewEncoder(file).Encode(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 func (ms *MemStorage) LoadFromFile() error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
-
 	if ms.filePath == "" {
 		return errors.New("file path not set")
 	}
@@ -158,18 +376,61 @@ func (ms *MemStorage) LoadFromFile() error {
 		if err != nil {
 			continue
 		}
-		ms.Gauges[k] = gauge(val)
+		ms.set(models.Metrics{ID: k, MType: "gauge", Value: &val})
 	}
 	for k, v := range data["counters"] {
 		val, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
 			continue
 		}
-		ms.Counters[k] = counter(val)
+		ms.set(models.Metrics{ID: k, MType: "counter", Delta: &val})
 	}
 	return nil
 }
 
-func (ms *MemStorage) Ping() error {
+func (ms *MemStorage) set(m models.Metrics) {
+	sh := &ms.shards[ms.shardIndex(m.ID)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.set(m)
+}
+
+// Restore replaces the whole content of the storage with metrics, taking the
+// values as absolute. Metrics that survive the restore keep growing their
+// versions.
+func (ms *MemStorage) Restore(metrics []models.Metrics) {
+	for i := range ms.shards {
+		ms.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range ms.shards {
+			ms.shards[i].mu.Unlock()
+		}
+	}()
+
+	var oldGauges [shardCount]map[string]*gaugeEntry
+	var oldCounters [shardCount]map[string]*counterEntry
+	for i := range ms.shards {
+		oldGauges[i], oldCounters[i] = ms.shards[i].gauges, ms.shards[i].counters
+		ms.shards[i].gauges = make(map[string]*gaugeEntry)
+		ms.shards[i].counters = make(map[string]*counterEntry)
+	}
+	for _, m := range metrics {
+		i := ms.shardIndex(m.ID)
+		switch m.MType {
+		case "gauge":
+			if e, ok := oldGauges[i][m.ID]; ok {
+				ms.shards[i].gauges[m.ID] = e
+			}
+		case "counter":
+			if e, ok := oldCounters[i][m.ID]; ok {
+				ms.shards[i].counters[m.ID] = e
+			}
+		}
+		ms.shards[i].set(m)
+	}
+}
+
+func (ms *MemStorage) Ping(ctx context.Context) error {
 	return nil
 }
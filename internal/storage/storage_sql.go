@@ -1,179 +1,361 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/kosta324/metrics.git/internal/db"
 	"github.com/kosta324/metrics.git/internal/models"
-	"strings"
+	"github.com/kosta324/metrics.git/internal/resilience"
+	"sort"
 	"time"
 )
 
 type SQLRepo struct {
-	db *sql.DB
+	db      *sql.DB
+	replica *replica
+	policy  *resilience.Policy
+	// instanceID tags change notifications so that an instance can skip its
+	// own writes.
+	instanceID string
 }
 
-func isRetriablePgError(err error) bool {
+func isConnectionPgError(err error) bool {
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
-		return strings.HasPrefix(pgErr.Code, pgerrcode.ConnectionException)
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.CannotConnectNow ||
+			pgErr.Code == pgerrcode.AdminShutdown ||
+			pgErr.Code == pgerrcode.CrashShutdown ||
+			pgErr.Code == pgerrcode.TooManyConnections
 	}
 	return false
 }
 
-func NewSQLStorage(dsn string) (*SQLRepo, error) {
-	db, err := sql.Open("pgx", dsn)
+// commit marks a commit that failed on a broken connection as ambiguous:
+// COMMIT may have been applied, and counter upserts are not idempotent, so
+// the batch must not be repeated.
+func commit(tx *sql.Tx) error {
+	err := tx.Commit()
+	if err != nil && isUnavailable(err) {
+		return fmt.Errorf("%w: %w", ErrAmbiguousCommit, err)
+	}
+	return err
+}
+
+func isRetriableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrAmbiguousCommit) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgerrcode.IsTransactionRollback(pgErr.Code) {
+		return true
+	}
+	return isUnavailable(err)
+}
+
+func newSQLPolicy() *resilience.Policy {
+	return &resilience.Policy{
+		Breaker:   resilience.NewBreaker(5, 10*time.Second),
+		Delays:    []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second},
+		Retriable: isRetriableError,
+		Failure:   isUnavailable,
+	}
+}
+
+func NewSQLStorage(ctx context.Context, cfg db.Config) (*SQLRepo, error) {
+	sqlDB, err := db.Open(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open DB: %w", err)
-	}
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping DB: %w", err)
-	}
-
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS gauges (
-            name TEXT PRIMARY KEY,
-            value DOUBLE PRECISION
-        );
-        CREATE TABLE IF NOT EXISTS counters (
-            name TEXT PRIMARY KEY,
-            delta BIGINT
-        );
-    `)
+		return nil, err
+	}
+
+	migrator, err := NewPostgresMigrator(sqlDB)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
 	}
+	if _, err := migrator.Up(ctx); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return &SQLRepo{db: sqlDB, policy: newSQLPolicy(), instanceID: newInstanceID()}, nil
+}
+
+func (r *SQLRepo) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.doWith(ctx, r.policy, fn)
+}
+
+func (r *SQLRepo) doWith(ctx context.Context, policy *resilience.Policy, fn func(ctx context.Context) error) error {
+	err := policy.Do(ctx, fn)
+	if errors.Is(err, resilience.ErrOpen) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return wrapDBError(err)
+}
 
-	return &SQLRepo{db: db}, nil
+func (r *SQLRepo) BreakerState() string {
+	return r.policy.Breaker.State().String()
 }
 
 func (r *SQLRepo) DB() *sql.DB {
 	return r.db
 }
 
-func (r *SQLRepo) Add(metricType, name, value string) error {
-	retries := []time.Duration{0, 1 * time.Second, 3 * time.Second, 5 * time.Second}
+func (r *SQLRepo) Add(ctx context.Context, m models.Metrics) error {
+	return r.AddBatch(ctx, []models.Metrics{m})
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func upsert(ctx context.Context, db execer, m models.Metrics) error {
 	var err error
-	for attempt, delay := range retries {
-		if attempt > 0 {
-			time.Sleep(delay)
-		}
-		switch metricType {
-		case "gauge":
-			_, err = r.db.Exec(`
-				INSERT INTO gauges (name, value)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-			`, name, value)
-		case "counter":
-			_, err = r.db.Exec(`
-				INSERT INTO counters (name, delta)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET delta = counters.delta + EXCLUDED.delta
-			`, name, value)
-		default:
-			return fmt.Errorf("unsupported metric type: %s", metricType)
-		}
-		if err == nil || !isRetriablePgError(err) {
-			break
-		}
+	switch m.MType {
+	case "gauge":
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO gauges (name, value)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, version = gauges.version + 1
+		`, m.ID, *m.Value)
+	case "counter":
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO counters (name, delta)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET delta = counters.delta + EXCLUDED.delta, version = counters.version + 1
+		`, m.ID, *m.Delta)
 	}
 	return err
 }
 
-func (r *SQLRepo) Get(metricType, name string) (string, error) {
-	var result string
+func (r *SQLRepo) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	m := models.Metrics{ID: name, MType: metricType}
+	var err error
 	switch metricType {
 	case "gauge":
-		err := r.db.QueryRow("SELECT value FROM gauges WHERE name = $1", name).Scan(&result)
-		return result, err
+		var v float64
+		err = r.read(ctx, func(ctx context.Context, db *sql.DB) error {
+			return db.QueryRowContext(ctx, "SELECT value FROM gauges WHERE name = $1", name).Scan(&v)
+		})
+		m.Value = &v
 	case "counter":
-		err := r.db.QueryRow("SELECT delta FROM counters WHERE name = $1", name).Scan(&result)
-		return result, err
+		var d int64
+		err = r.read(ctx, func(ctx context.Context, db *sql.DB) error {
+			return db.QueryRowContext(ctx, "SELECT delta FROM counters WHERE name = $1", name).Scan(&d)
+		})
+		m.Delta = &d
 	default:
-		return "", fmt.Errorf("unsupported metric type: %s", metricType)
+		return models.Metrics{}, fmt.Errorf("%w: %s", ErrUnsupportedType, metricType)
 	}
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	return m, nil
 }
 
-func (r *SQLRepo) GetAll() map[string]string {
-	result := make(map[string]string)
-	rows, err := r.db.Query("SELECT name, value FROM gauges")
+func (r *SQLRepo) GetVersioned(ctx context.Context, metricType, name string) (models.Metrics, int64, error) {
+	var m models.Metrics
+	var version int64
+	err := r.read(ctx, func(ctx context.Context, db *sql.DB) error {
+		var err error
+		m, version, err = getVersioned(ctx, db, metricType, name)
+		return err
+	})
 	if err != nil {
-		return result
+		return models.Metrics{}, 0, err
+	}
+	return m, version, nil
+}
+
+// getVersioned reads a metric and its version in one query.
+func getVersioned(ctx context.Context, db *sql.DB, metricType, name string) (models.Metrics, int64, error) {
+	m := models.Metrics{ID: name, MType: metricType}
+	var version int64
+	var err error
+	switch metricType {
+	case "gauge":
+		var v float64
+		err = db.QueryRowContext(ctx, "SELECT value, version FROM gauges WHERE name = $1", name).Scan(&v, &version)
+		m.Value = &v
+	case "counter":
+		var d int64
+		err = db.QueryRowContext(ctx, "SELECT delta, version FROM counters WHERE name = $1", name).Scan(&d, &version)
+		m.Delta = &d
+	default:
+		return models.Metrics{}, 0, fmt.Errorf("%w: %s", ErrUnsupportedType, metricType)
+	}
+	if err != nil {
+		return models.Metrics{}, 0, err
+	}
+	return m, version, nil
+}
+
+func (r *SQLRepo) GetAll(ctx context.Context) ([]models.Metrics, error) {
+	var result []models.Metrics
+	err := r.read(ctx, func(ctx context.Context, db *sql.DB) error {
+		result = nil
+		return getAll(ctx, db, &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getAll(ctx context.Context, db *sql.DB, result *[]models.Metrics) error {
+	rows, err := db.QueryContext(ctx, "SELECT name, value FROM gauges")
+	if err != nil {
+		return fmt.Errorf("failed to query gauges: %w", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var name, val string
-		if err := rows.Scan(&name, &val); err == nil {
-			result[name] = val
+		var name string
+		var v float64
+		if err := rows.Scan(&name, &v); err != nil {
+			return fmt.Errorf("failed to scan gauge: %w", err)
 		}
+		*result = append(*result, models.Metrics{ID: name, MType: "gauge", Value: &v})
 	}
 	if err := rows.Err(); err != nil {
-		fmt.Printf("error reading gauges: %v\n", err)
+		return fmt.Errorf("error reading gauges: %w", err)
 	}
 
-	rows, err = r.db.Query("SELECT name, delta FROM counters")
+	rows, err = db.QueryContext(ctx, "SELECT name, delta FROM counters")
 	if err != nil {
-		return result
+		return fmt.Errorf("failed to query counters: %w", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var name, val string
-		if err := rows.Scan(&name, &val); err == nil {
-			result[name] = val
+		var name string
+		var d int64
+		if err := rows.Scan(&name, &d); err != nil {
+			return fmt.Errorf("failed to scan counter: %w", err)
 		}
+		*result = append(*result, models.Metrics{ID: name, MType: "counter", Delta: &d})
 	}
 	if err := rows.Err(); err != nil {
-		fmt.Printf("error reading counters: %v\n", err)
+		return fmt.Errorf("error reading counters: %w", err)
 	}
+	return nil
+}
 
-	return result
+type batchGauge struct {
+	name  string
+	value float64
 }
 
-func (r *SQLRepo) AddBatch(metrics []models.Metrics) error {
-	tx, err := r.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+type batchCounter struct {
+	name  string
+	delta int64
+}
+
+func aggregateBatch(metrics []models.Metrics) ([]batchGauge, []batchCounter) {
+	gaugeIdx := make(map[string]int)
+	counterIdx := make(map[string]int)
+	var gauges []batchGauge
+	var counters []batchCounter
 
 	for _, m := range metrics {
 		switch m.MType {
 		case "gauge":
-			if m.Value == nil {
-				return fmt.Errorf("missing gauge value for metric %s", m.ID)
-			}
-			_, err := tx.Exec(`
-				INSERT INTO gauges (name, value)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-			`, m.ID, *m.Value)
-			if err != nil {
-				return err
+			if i, ok := gaugeIdx[m.ID]; ok {
+				gauges[i].value = *m.Value
+				continue
 			}
+			gaugeIdx[m.ID] = len(gauges)
+			gauges = append(gauges, batchGauge{name: m.ID, value: *m.Value})
 		case "counter":
-			if m.Delta == nil {
-				return fmt.Errorf("missing counter delta for metric %s", m.ID)
+			if i, ok := counterIdx[m.ID]; ok {
+				counters[i].delta += *m.Delta
+				continue
 			}
-			_, err := tx.Exec(`
-				INSERT INTO counters (name, delta)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET delta = counters.delta + EXCLUDED.delta
-			`, m.ID, *m.Delta)
-			if err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("unknown metric type: %s", m.MType)
+			counterIdx[m.ID] = len(counters)
+			counters = append(counters, batchCounter{name: m.ID, delta: *m.Delta})
 		}
 	}
 
-	return tx.Commit()
+	sort.Slice(gauges, func(i, j int) bool { return gauges[i].name < gauges[j].name })
+	sort.Slice(counters, func(i, j int) bool { return counters[i].name < counters[j].name })
+	return gauges, counters
 }
 
-func (r *SQLRepo) Ping() error {
-	return r.db.Ping()
+func (r *SQLRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := Validate(m); err != nil {
+			return err
+		}
+	}
+	gauges, counters := aggregateBatch(metrics)
+
+	return r.do(ctx, func(ctx context.Context) error {
+		return r.addBatch(ctx, gauges, counters)
+	})
+}
+
+func (r *SQLRepo) addBatch(ctx context.Context, gauges []batchGauge, counters []batchCounter) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(gauges) > 0 {
+		names := make([]string, len(gauges))
+		values := make([]float64, len(gauges))
+		for i, g := range gauges {
+			names[i], values[i] = g.name, g.value
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO gauges (name, value)
+			SELECT * FROM unnest($1::text[], $2::double precision[])
+			ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, version = gauges.version + 1
+		`, names, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(counters) > 0 {
+		names := make([]string, len(counters))
+		deltas := make([]int64, len(counters))
+		for i, c := range counters {
+			names[i], deltas[i] = c.name, c.delta
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO counters (name, delta)
+			SELECT * FROM unnest($1::text[], $2::bigint[])
+			ON CONFLICT (name) DO UPDATE SET delta = counters.delta + EXCLUDED.delta, version = counters.version + 1
+		`, names, deltas)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := notifyChange(ctx, tx, r.instanceID, gauges, counters); err != nil {
+		return fmt.Errorf("failed to notify change: %w", err)
+	}
+
+	return commit(tx)
+}
+
+// Ping is a health check and fails fast instead of waiting out the retries;
+// it still goes through the breaker.
+func (r *SQLRepo) Ping(ctx context.Context) error {
+	once := *r.policy
+	once.Delays = nil
+	return r.doWith(ctx, &once, r.db.PingContext)
+}
+
+func (r *SQLRepo) Close() error {
+	if r.replica != nil {
+		r.replica.db.Close()
+	}
+	return r.db.Close()
 }
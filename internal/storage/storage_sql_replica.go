@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	replicaCheckInterval = time.Second
+	replicaCheckTimeout  = time.Second
+)
+
+// replica routes reads to a standby as long as it answers and its replay lag
+// stays within maxLag. Health is re-checked at most once per
+// replicaCheckInterval; other readers use the last known state meanwhile.
+type replica struct {
+	db     *sql.DB
+	maxLag time.Duration
+	lag    func(ctx context.Context) (time.Duration, error)
+
+	mu        sync.Mutex
+	checking  bool
+	checkedAt time.Time
+	healthy   bool
+}
+
+func newReplica(db *sql.DB, maxLag time.Duration) *replica {
+	rp := &replica{db: db, maxLag: maxLag}
+	rp.lag = rp.replayLag
+	return rp
+}
+
+// replayLag is zero while the standby has replayed everything it received, so
+// an idle primary does not make the replica look stale.
+func (rp *replica) replayLag(ctx context.Context) (time.Duration, error) {
+	var seconds float64
+	err := rp.db.QueryRowContext(ctx, `
+		SELECT CASE
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END
+	`).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (rp *replica) usable(ctx context.Context) bool {
+	rp.mu.Lock()
+	if rp.checking || time.Since(rp.checkedAt) < replicaCheckInterval {
+		healthy := rp.healthy
+		rp.mu.Unlock()
+		return healthy
+	}
+	rp.checking = true
+	rp.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	lag, err := rp.lag(ctx)
+	cancel()
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.checking = false
+	rp.checkedAt = time.Now()
+	rp.healthy = err == nil && lag <= rp.maxLag
+	return rp.healthy
+}
+
+func (rp *replica) markUnhealthy() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.healthy = false
+	rp.checkedAt = time.Now()
+}
+
+type primaryReadsKey struct{}
+
+// withPrimaryReads makes SQLRepo skip the replica for reads done with ctx, for
+// callers that must observe a write that was just committed.
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// SetReplica sends Get and GetAll to replicaDB while it is reachable and lags
+// the primary by no more than maxLag. Writes always go to the primary.
+func (r *SQLRepo) SetReplica(replicaDB *sql.DB, maxLag time.Duration) {
+	r.replica = newReplica(replicaDB, maxLag)
+}
+
+// read runs fn against the replica when it is usable and falls back to the
+// primary, with the usual retry policy, if the replica fails.
+func (r *SQLRepo) read(ctx context.Context, fn func(ctx context.Context, db *sql.DB) error) error {
+	if rp := r.replica; rp != nil && ctx.Value(primaryReadsKey{}) == nil && rp.usable(ctx) {
+		err := fn(ctx, rp.db)
+		if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+			return wrapDBError(err)
+		}
+		rp.markUnhealthy()
+	}
+
+	return r.do(ctx, func(ctx context.Context) error {
+		return fn(ctx, r.db)
+	})
+}
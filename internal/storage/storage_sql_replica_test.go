@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openMigratedSQLite(t *testing.T, name string) *sql.DB {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), name))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := NewSQLiteMigrator(db)
+	require.NoError(t, err)
+	_, err = migrator.Up(context.Background())
+	require.NoError(t, err)
+	return db
+}
+
+func TestSQLRepoReplicaRouting(t *testing.T) {
+	ctx := context.Background()
+	primary := openMigratedSQLite(t, "primary.db")
+	standby := openMigratedSQLite(t, "replica.db")
+
+	_, err := primary.Exec("INSERT INTO gauges (name, value) VALUES ('Alloc', 1)")
+	require.NoError(t, err)
+	_, err = standby.Exec("INSERT INTO gauges (name, value) VALUES ('Alloc', 2)")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		lag   time.Duration
+		close bool
+		want  float64
+	}{
+		{name: "replica in sync", want: 2},
+		{name: "replica lagging", lag: time.Minute, want: 1},
+		{name: "replica unreachable", close: true, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &SQLRepo{db: primary, policy: newSQLPolicy()}
+			repo.SetReplica(standby, 5*time.Second)
+			repo.replica.lag = func(ctx context.Context) (time.Duration, error) { return tt.lag, nil }
+			if tt.close {
+				broken := openMigratedSQLite(t, "broken.db")
+				broken.Close()
+				repo.replica.db = broken
+			}
+
+			m, err := repo.Get(ctx, "gauge", "Alloc")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *m.Value)
+
+			all, err := repo.GetAll(ctx)
+			require.NoError(t, err)
+			require.Len(t, all, 1)
+			assert.Equal(t, tt.want, *all[0].Value)
+		})
+	}
+}
+
+func TestSQLRepoPrimaryReads(t *testing.T) {
+	primary := openMigratedSQLite(t, "primary.db")
+	standby := openMigratedSQLite(t, "replica.db")
+	_, err := primary.Exec("INSERT INTO counters (name, delta) VALUES ('PollCount', 1)")
+	require.NoError(t, err)
+
+	repo := &SQLRepo{db: primary, policy: newSQLPolicy()}
+	repo.SetReplica(standby, 5*time.Second)
+	repo.replica.lag = func(ctx context.Context) (time.Duration, error) { return 0, nil }
+
+	_, err = repo.Get(context.Background(), "counter", "PollCount")
+	assert.ErrorIs(t, err, ErrNotFound, "the replica has not seen the write yet")
+
+	m, err := repo.Get(withPrimaryReads(context.Background()), "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *m.Delta)
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/kosta324/metrics.git/internal/db"
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateBatch(t *testing.T) {
+	g := func(id string, v float64) models.Metrics { return models.Metrics{ID: id, MType: "gauge", Value: &v} }
+	c := func(id string, d int64) models.Metrics { return models.Metrics{ID: id, MType: "counter", Delta: &d} }
+
+	gauges, counters := aggregateBatch([]models.Metrics{
+		g("Zeta", 1), c("PollCount", 2), g("Alloc", 3), c("Errors", 1), g("Zeta", 4), c("PollCount", 5),
+	})
+
+	assert.Equal(t, []batchGauge{{name: "Alloc", value: 3}, {name: "Zeta", value: 4}}, gauges)
+	assert.Equal(t, []batchCounter{{name: "Errors", delta: 1}, {name: "PollCount", delta: 7}}, counters)
+}
+
+func TestIsRetriableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "serialization failure", err: &pgconn.PgError{Code: pgerrcode.SerializationFailure}, want: true},
+		{name: "unique violation", err: &pgconn.PgError{Code: pgerrcode.UniqueViolation}, want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "bad connection at commit", err: fmt.Errorf("%w: %w", ErrAmbiguousCommit, driver.ErrBadConn), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetriableError(tt.err))
+		})
+	}
+}
+
+func TestWrapDBErrorKeepsAmbiguousCommit(t *testing.T) {
+	err := wrapDBError(fmt.Errorf("%w: %w", ErrAmbiguousCommit, driver.ErrBadConn))
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorIs(t, err, ErrAmbiguousCommit)
+}
+
+func TestSQLRepoPingFailsFast(t *testing.T) {
+	connCfg, err := pgx.ParseConfig("postgres://localhost:1/metrics?sslmode=disable&connect_timeout=1")
+	require.NoError(t, err)
+	sqlDB := stdlib.OpenDB(*connCfg)
+	defer sqlDB.Close()
+	r := &SQLRepo{db: sqlDB, policy: newSQLPolicy()}
+
+	start := time.Now()
+	require.ErrorIs(t, r.Ping(context.Background()), ErrUnavailable)
+	assert.Less(t, time.Since(start), time.Second, "Ping must not be retried")
+}
+
+func addBatchRowByRow(ctx context.Context, r *SQLRepo, metrics []models.Metrics) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range metrics {
+		if err := upsert(ctx, tx, m); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func benchmarkBatch(size int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, size)
+	for i := 0; i < size; i++ {
+		name := fmt.Sprintf("bench_%d", rand.Intn(size))
+		if i%2 == 0 {
+			v := rand.Float64()
+			metrics = append(metrics, models.Metrics{ID: name, MType: "gauge", Value: &v})
+		} else {
+			d := rand.Int63n(100)
+			metrics = append(metrics, models.Metrics{ID: name, MType: "counter", Delta: &d})
+		}
+	}
+	return metrics
+}
+
+func BenchmarkSQLRepoAddBatch(b *testing.B) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN is not set")
+	}
+	repo, err := NewSQLStorage(context.Background(), db.DefaultConfig(dsn))
+	if err != nil {
+		b.Fatalf("failed to connect to DB: %v", err)
+	}
+	ctx := context.Background()
+
+	for _, size := range []int{10, 100, 1000, 5000} {
+		batch := benchmarkBatch(size)
+
+		b.Run(fmt.Sprintf("row_by_row/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := addBatchRowByRow(ctx, repo, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("unnest/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := repo.AddBatch(ctx, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteRepo struct {
+	db *sql.DB
+}
+
+func SQLitePath(dsn string) (string, bool) {
+	if path, ok := strings.CutPrefix(dsn, "sqlite://"); ok {
+		return path, true
+	}
+	if strings.Contains(dsn, "://") || strings.Contains(dsn, "=") {
+		return "", false
+	}
+	for _, ext := range []string{".db", ".sqlite", ".sqlite3"} {
+		if strings.HasSuffix(dsn, ext) {
+			return dsn, true
+		}
+	}
+	return "", false
+}
+
+func OpenSQLite(path string) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DB: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping DB: %w", err)
+	}
+	return db, nil
+}
+
+func NewSQLiteStorage(path string) (*SQLiteRepo, error) {
+	db, err := OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator, err := NewSQLiteMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return &SQLiteRepo{db: db}, nil
+}
+
+func (r *SQLiteRepo) DB() *sql.DB {
+	return r.db
+}
+
+func (r *SQLiteRepo) Add(ctx context.Context, m models.Metrics) error {
+	if err := Validate(m); err != nil {
+		return err
+	}
+	return wrapDBError(upsert(ctx, r.db, m))
+}
+
+func (r *SQLiteRepo) AddBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := Validate(m); err != nil {
+			return err
+		}
+	}
+	gauges, counters := aggregateBatch(metrics)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapDBError(err)
+	}
+	defer tx.Rollback()
+
+	for _, g := range gauges {
+		if err := upsert(ctx, tx, models.Metrics{ID: g.name, MType: "gauge", Value: &g.value}); err != nil {
+			return wrapDBError(err)
+		}
+	}
+	for _, c := range counters {
+		if err := upsert(ctx, tx, models.Metrics{ID: c.name, MType: "counter", Delta: &c.delta}); err != nil {
+			return wrapDBError(err)
+		}
+	}
+
+	return wrapDBError(tx.Commit())
+}
+
+func (r *SQLiteRepo) Get(ctx context.Context, metricType, name string) (models.Metrics, error) {
+	m := models.Metrics{ID: name, MType: metricType}
+	switch metricType {
+	case "gauge":
+		var v float64
+		if err := r.db.QueryRowContext(ctx, "SELECT value FROM gauges WHERE name = $1", name).Scan(&v); err != nil {
+			return models.Metrics{}, wrapDBError(err)
+		}
+		m.Value = &v
+	case "counter":
+		var d int64
+		if err := r.db.QueryRowContext(ctx, "SELECT delta FROM counters WHERE name = $1", name).Scan(&d); err != nil {
+			return models.Metrics{}, wrapDBError(err)
+		}
+		m.Delta = &d
+	default:
+		return models.Metrics{}, fmt.Errorf("%w: %s", ErrUnsupportedType, metricType)
+	}
+	return m, nil
+}
+
+func (r *SQLiteRepo) GetVersioned(ctx context.Context, metricType, name string) (models.Metrics, int64, error) {
+	m, version, err := getVersioned(ctx, r.db, metricType, name)
+	if err != nil {
+		return models.Metrics{}, 0, wrapDBError(err)
+	}
+	return m, version, nil
+}
+
+func (r *SQLiteRepo) GetAll(ctx context.Context) ([]models.Metrics, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT name, 'gauge', value, NULL FROM gauges
+		UNION ALL
+		SELECT name, 'counter', NULL, delta FROM counters
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", wrapDBError(err))
+	}
+	defer rows.Close()
+
+	var result []models.Metrics
+	for rows.Next() {
+		var m models.Metrics
+		if err := rows.Scan(&m.ID, &m.MType, &m.Value, &m.Delta); err != nil {
+			return nil, fmt.Errorf("failed to scan metric: %w", wrapDBError(err))
+		}
+		result = append(result, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading metrics: %w", wrapDBError(err))
+	}
+	return result, nil
+}
+
+func (r *SQLiteRepo) Ping(ctx context.Context) error {
+	return wrapDBError(r.db.PingContext(ctx))
+}
+
+func (r *SQLiteRepo) Close() error {
+	return r.db.Close()
+}
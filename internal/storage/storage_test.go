@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStorageFileRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	ms := NewMemStorage()
+	ms.SetFilePath(path)
+	v, d := 603057.87, int64(42)
+	require.NoError(t, ms.AddBatch(ctx, []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &v},
+		{ID: "PollCount", MType: "counter", Delta: &d},
+	}))
+	require.NoError(t, ms.SaveToFile())
+
+	restored := NewMemStorage()
+	restored.SetFilePath(path)
+	require.NoError(t, restored.LoadFromFile())
+	require.NoError(t, restored.LoadFromFile())
+
+	g, err := restored.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, v, *g.Value)
+
+	c, err := restored.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, d, *c.Delta)
+}
+
+func TestMemStorageRestoreKeepsVersions(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage()
+	v, d := 1.0, int64(1)
+	require.NoError(t, ms.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}))
+	require.NoError(t, ms.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}))
+	require.NoError(t, ms.Add(ctx, models.Metrics{ID: "Old", MType: "counter", Delta: &d}))
+
+	v2 := 2.0
+	ms.Restore([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &v2},
+		{ID: "PollCount", MType: "counter", Delta: &d},
+	})
+
+	_, version, err := ms.GetVersioned(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), version)
+	_, version, err = ms.GetVersioned(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+	_, _, err = ms.GetVersioned(ctx, "counter", "Old")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemStorageGetAllSeesWholeBatches(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage()
+	batch := make([]models.Metrics, 200)
+	for i := range batch {
+		d := int64(1)
+		batch[i] = models.Metrics{ID: fmt.Sprintf("c%d", i), MType: "counter", Delta: &d}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			ms.AddBatch(ctx, batch)
+		}
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		metrics, err := ms.GetAll(ctx)
+		require.NoError(t, err)
+		if len(metrics) == 0 {
+			continue
+		}
+		require.Len(t, metrics, len(batch), "snapshot has part of a batch")
+		for _, m := range metrics {
+			require.Equal(t, *metrics[0].Delta, *m.Delta, "snapshot has part of a batch")
+		}
+	}
+}
+
+// lockedStorage is the previous single-mutex MemStorage design, kept as a
+// baseline for the benchmarks below.
+type lockedStorage struct {
+	mu       sync.RWMutex
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func (ls *lockedStorage) Add(ctx context.Context, m models.Metrics) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if m.MType == "gauge" {
+		ls.gauges[m.ID] = *m.Value
+	} else {
+		ls.counters[m.ID] += *m.Delta
+	}
+	return nil
+}
+
+// saveToFile writes the same file as MemStorage.SaveToFile, so that the
+// benchmarks only differ in locking.
+func (ls *lockedStorage) saveToFile(path string) error {
+	data := map[string]map[string]string{
+		"gauges":   {},
+		"counters": {},
+	}
+	ls.mu.RLock()
+	for k, v := range ls.gauges {
+		data["gauges"][k] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for k, d := range ls.counters {
+		data["counters"][k] = strconv.FormatInt(d, 10)
+	}
+	ls.mu.RUnlock()
+	return writeFile(path, data)
+}
+
+type adder interface {
+	Add(ctx context.Context, m models.Metrics) error
+}
+
+func benchmarkAgents(b *testing.B, repo adder, snapshot func()) {
+	const metricsPerAgent = 30
+	ctx := context.Background()
+
+	if snapshot != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					snapshot()
+				}
+			}
+		}()
+	}
+
+	var agentID atomic.Int64
+	b.SetParallelism(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		agent := agentID.Add(1)
+		names := make([]string, metricsPerAgent)
+		for i := range names {
+			names[i] = fmt.Sprintf("agent%d_metric%d", agent, i)
+		}
+		i := 0
+		for pb.Next() {
+			name := names[i%metricsPerAgent]
+			if i%2 == 0 {
+				v := float64(i)
+				repo.Add(ctx, models.Metrics{ID: name, MType: "gauge", Value: &v})
+			} else {
+				d := int64(1)
+				repo.Add(ctx, models.Metrics{ID: name, MType: "counter", Delta: &d})
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemStorageAgents(b *testing.B) {
+	b.Run("single_lock", func(b *testing.B) {
+		ls := &lockedStorage{gauges: map[string]float64{}, counters: map[string]int64{}}
+		benchmarkAgents(b, ls, nil)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkAgents(b, NewMemStorage(), nil)
+	})
+	b.Run("single_lock_with_snapshots", func(b *testing.B) {
+		ls := &lockedStorage{gauges: map[string]float64{}, counters: map[string]int64{}}
+		path := filepath.Join(b.TempDir(), "metrics.json")
+		benchmarkAgents(b, ls, func() { ls.saveToFile(path) })
+	})
+	b.Run("sharded_with_snapshots", func(b *testing.B) {
+		ms := NewMemStorage()
+		ms.SetFilePath(filepath.Join(b.TempDir(), "metrics.json"))
+		benchmarkAgents(b, ms, func() { ms.SaveToFile() })
+	})
+}
@@ -0,0 +1,390 @@
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/kosta324/metrics.git/internal/models"
+	"github.com/kosta324/metrics.git/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func Counter(id string, d int64) models.Metrics {
+	return models.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+// Run checks that a storage.Repository behaves the same way as the reference
+// MemStorage. newRepo must return an empty repository on every call.
+func Run(t *testing.T, newRepo func(t *testing.T) storage.Repository) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo storage.Repository)
+	}{
+		{name: "add and get gauge", fn: testAddGetGauge},
+		{name: "overwrite gauge", fn: testOverwriteGauge},
+		{name: "accumulate counter", fn: testAccumulateCounter},
+		{name: "gauge and counter with same name", fn: testSameName},
+		{name: "not found", fn: testNotFound},
+		{name: "unsupported type", fn: testUnsupportedType},
+		{name: "invalid value", fn: testInvalidValue},
+		{name: "batch", fn: testBatch},
+		{name: "batch atomicity", fn: testBatchAtomicity},
+		{name: "concurrent writers", fn: testConcurrentWriters},
+		{name: "get all consistency", fn: testGetAllConsistency},
+		{name: "list filters and pages", fn: testList},
+		{name: "aggregate", fn: testAggregate},
+		{name: "versions", fn: testVersions},
+		{name: "ping", fn: testPing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepo(t))
+		})
+	}
+}
+
+func testAddGetGauge(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Gauge("Alloc", 603057.87)))
+
+	m, err := repo.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "Alloc", m.ID)
+	assert.Equal(t, "gauge", m.MType)
+	require.NotNil(t, m.Value)
+	assert.Nil(t, m.Delta)
+	assert.Equal(t, 603057.87, *m.Value)
+	assert.Equal(t, "603057.87", m.ValueString())
+}
+
+func testOverwriteGauge(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Gauge("Alloc", 1)))
+	require.NoError(t, repo.Add(ctx, Gauge("Alloc", -2.5)))
+
+	m, err := repo.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, -2.5, *m.Value)
+}
+
+func testAccumulateCounter(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Counter("PollCount", 5)))
+	require.NoError(t, repo.Add(ctx, Counter("PollCount", 7)))
+	require.NoError(t, repo.Add(ctx, Counter("PollCount", -2)))
+
+	m, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	require.NotNil(t, m.Delta)
+	assert.Nil(t, m.Value)
+	assert.Equal(t, int64(10), *m.Delta)
+}
+
+func testSameName(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Gauge("Metric", 1.5)))
+	require.NoError(t, repo.Add(ctx, Counter("Metric", 3)))
+
+	g, err := repo.Get(ctx, "gauge", "Metric")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *g.Value)
+
+	c, err := repo.Get(ctx, "counter", "Metric")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *c.Delta)
+}
+
+func testNotFound(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Counter("Known", 1)))
+
+	_, err := repo.Get(ctx, "gauge", "Unknown")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = repo.Get(ctx, "gauge", "Known")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testUnsupportedType(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	v := 1.0
+	err := repo.Add(ctx, models.Metrics{ID: "Histogram", MType: "histogram", Value: &v})
+	assert.ErrorIs(t, err, storage.ErrUnsupportedType)
+
+	_, err = repo.Get(ctx, "histogram", "Histogram")
+	assert.ErrorIs(t, err, storage.ErrUnsupportedType)
+}
+
+func testInvalidValue(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	err := repo.Add(ctx, models.Metrics{ID: "Alloc", MType: "gauge"})
+	assert.ErrorIs(t, err, storage.ErrInvalidValue)
+
+	err = repo.Add(ctx, models.Metrics{ID: "PollCount", MType: "counter"})
+	assert.ErrorIs(t, err, storage.ErrInvalidValue)
+
+	_, err = repo.Get(ctx, "gauge", "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testBatch(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Counter("PollCount", 1)))
+	require.NoError(t, repo.AddBatch(ctx, []models.Metrics{
+		Gauge("Alloc", 1),
+		Counter("PollCount", 2),
+		Gauge("Alloc", 2),
+		Counter("PollCount", 3),
+	}))
+
+	g, err := repo.Get(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *g.Value)
+
+	c, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *c.Delta)
+
+	assert.NoError(t, repo.AddBatch(ctx, nil))
+}
+
+func testBatchAtomicity(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.Add(ctx, Counter("PollCount", 1)))
+
+	err := repo.AddBatch(ctx, []models.Metrics{
+		Gauge("Alloc", 1),
+		Counter("PollCount", 2),
+		{ID: "Broken", MType: "gauge"},
+	})
+	assert.ErrorIs(t, err, storage.ErrInvalidValue)
+
+	err = repo.AddBatch(ctx, []models.Metrics{
+		Counter("PollCount", 2),
+		{ID: "Histogram", MType: "histogram"},
+	})
+	assert.ErrorIs(t, err, storage.ErrUnsupportedType)
+
+	_, err = repo.Get(ctx, "gauge", "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	c, err := repo.Get(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *c.Delta)
+}
+
+func testConcurrentWriters(t *testing.T, repo storage.Repository) {
+	const writers, iterations = 8, 50
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*iterations)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if i%2 == 0 {
+					errs <- repo.Add(ctx, Counter("Shared", 1))
+				} else {
+					errs <- repo.AddBatch(ctx, []models.Metrics{
+						Counter("Shared", 1),
+						Gauge(fmt.Sprintf("Writer%d", w), float64(i)),
+					})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	c, err := repo.Get(ctx, "counter", "Shared")
+	require.NoError(t, err)
+	assert.Equal(t, int64(writers*iterations), *c.Delta)
+
+	for w := 0; w < writers; w++ {
+		g, err := repo.Get(ctx, "gauge", fmt.Sprintf("Writer%d", w))
+		require.NoError(t, err)
+		assert.Equal(t, float64(iterations-1), *g.Value)
+	}
+}
+
+func testGetAllConsistency(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	all, err := repo.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+
+	require.NoError(t, repo.AddBatch(ctx, []models.Metrics{
+		Gauge("GaugeTwoDecimals", 603057.87),
+		Gauge("GaugeThreeDecimals", 550386.837),
+		Gauge("Shared", 0.1),
+		Counter("PollCount", 7),
+		Counter("Shared", 2),
+	}))
+
+	all, err = repo.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 5)
+
+	for _, m := range all {
+		got, err := repo.Get(ctx, m.MType, m.ID)
+		require.NoError(t, err)
+		assert.Equal(t, got, m)
+	}
+
+	values := make(map[string]string)
+	for _, m := range all {
+		values[m.MType+"/"+m.ID] = m.ValueString()
+	}
+	assert.Equal(t, map[string]string{
+		"gauge/GaugeTwoDecimals":   "603057.87",
+		"gauge/GaugeThreeDecimals": "550386.837",
+		"gauge/Shared":             "0.1",
+		"counter/PollCount":        "7",
+		"counter/Shared":           "2",
+	}, values)
+}
+
+func testAggregate(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.AddBatch(ctx, []models.Metrics{
+		Gauge("dc1/HeapAlloc", 10),
+		Gauge("dc2/HeapAlloc", 30),
+		Gauge("dc3/HeapAlloc", 20),
+		Gauge("HeapAlloc_total", 1000),
+		Gauge("a%b", 7),
+		Counter("dc1/HeapAlloc", 5),
+		Counter("PollCount", 4),
+	}))
+
+	float := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name  string
+		q     storage.AggregateQuery
+		count int64
+		value *float64
+	}{
+		{name: "sum glob", q: storage.AggregateQuery{Op: "sum", Type: "gauge", Glob: "*/HeapAlloc"}, count: 3, value: float(60)},
+		{name: "avg glob", q: storage.AggregateQuery{Op: "avg", Type: "gauge", Glob: "dc?/HeapAlloc"}, count: 3, value: float(20)},
+		{name: "min", q: storage.AggregateQuery{Op: "min", Type: "gauge", Glob: "*HeapAlloc*"}, count: 4, value: float(10)},
+		{name: "max all", q: storage.AggregateQuery{Op: "max", Type: "gauge"}, count: 5, value: float(1000)},
+		{name: "count regex", q: storage.AggregateQuery{Op: "count", Type: "gauge", Regex: regexp.MustCompile(`^dc[12]/`)}, count: 2, value: float(2)},
+		{name: "glob wildcards are literal in SQL", q: storage.AggregateQuery{Op: "sum", Type: "gauge", Glob: "a%b"}, count: 1, value: float(7)},
+		{name: "question mark matches one character", q: storage.AggregateQuery{Op: "count", Type: "gauge", Glob: "HeapAlloc?total"}, count: 1, value: float(1)},
+		{name: "counters", q: storage.AggregateQuery{Op: "sum", Type: "counter"}, count: 2, value: float(9)},
+		{name: "no match sum", q: storage.AggregateQuery{Op: "sum", Type: "gauge", Glob: "none*"}, count: 0, value: float(0)},
+		{name: "no match avg", q: storage.AggregateQuery{Op: "avg", Type: "gauge", Glob: "none*"}, count: 0, value: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storage.AggregateMetrics(ctx, repo, tt.q)
+			require.NoError(t, err)
+			assert.Equal(t, tt.count, got.Count)
+			if tt.value == nil {
+				assert.Nil(t, got.Value)
+				return
+			}
+			require.NotNil(t, got.Value)
+			assert.InDelta(t, *tt.value, *got.Value, 1e-9)
+		})
+	}
+
+	_, err := storage.AggregateMetrics(ctx, repo, storage.AggregateQuery{Op: "median", Type: "gauge"})
+	assert.ErrorIs(t, err, storage.ErrInvalidValue)
+	_, err = storage.AggregateMetrics(ctx, repo, storage.AggregateQuery{Op: "sum", Type: "histogram"})
+	assert.ErrorIs(t, err, storage.ErrUnsupportedType)
+}
+
+func testVersions(t *testing.T, repo storage.Repository) {
+	v, ok := repo.(storage.Versioner)
+	if !ok {
+		t.Skip("repository does not track versions")
+	}
+	ctx := context.Background()
+
+	_, _, err := v.GetVersioned(ctx, "gauge", "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, _, err = v.GetVersioned(ctx, "histogram", "Alloc")
+	assert.ErrorIs(t, err, storage.ErrUnsupportedType)
+
+	require.NoError(t, repo.Add(ctx, Gauge("Alloc", 1)))
+	require.NoError(t, repo.Add(ctx, Counter("Alloc", 1)))
+	m, version, err := v.GetVersioned(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+	assert.Equal(t, 1.0, *m.Value)
+
+	require.NoError(t, repo.AddBatch(ctx, []models.Metrics{Gauge("Alloc", 2), Counter("PollCount", 1)}))
+	require.NoError(t, repo.Add(ctx, Gauge("Alloc", 2)))
+	m, version, err = v.GetVersioned(ctx, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), version, "every write bumps the version, even with the same value")
+	assert.Equal(t, 2.0, *m.Value)
+
+	m, version, err = v.GetVersioned(ctx, "counter", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), version, "types are versioned separately")
+	assert.Equal(t, int64(1), *m.Delta)
+}
+
+func testPing(t *testing.T, repo storage.Repository) {
+	assert.NoError(t, repo.Ping(context.Background()))
+}
+
+func ids(metrics []models.Metrics) []string {
+	var result []string
+	for _, m := range metrics {
+		result = append(result, m.MType+":"+m.ID)
+	}
+	return result
+}
+
+func testList(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.AddBatch(ctx, []models.Metrics{
+		Gauge("b", 1), Counter("a", 1), Gauge("a", 2), Gauge("Z", 3),
+		Counter("a_b", 4), Gauge("a%b", 5), Gauge("A", 6),
+	}))
+
+	tests := []struct {
+		name string
+		opts storage.ListOptions
+		want []string
+	}{
+		{name: "all in byte order", want: []string{"gauge:A", "gauge:Z", "counter:a", "gauge:a", "gauge:a%b", "counter:a_b", "gauge:b"}},
+		{name: "type", opts: storage.ListOptions{Type: "counter"}, want: []string{"counter:a", "counter:a_b"}},
+		{name: "prefix is literal and case sensitive", opts: storage.ListOptions{Prefix: "a_"}, want: []string{"counter:a_b"}},
+		{name: "regex", opts: storage.ListOptions{Regex: regexp.MustCompile(`^[A-Z]$`)}, want: []string{"gauge:A", "gauge:Z"}},
+		{name: "limit", opts: storage.ListOptions{Limit: 2}, want: []string{"gauge:A", "gauge:Z"}},
+		{name: "cursor between types", opts: storage.ListOptions{AfterID: "a", AfterType: "counter", Limit: 2}, want: []string{"gauge:a", "gauge:a%b"}},
+		{name: "regex with limit and cursor", opts: storage.ListOptions{Regex: regexp.MustCompile(`^a`), AfterID: "a", AfterType: "gauge", Limit: 1}, want: []string{"gauge:a%b"}},
+		{name: "past the end", opts: storage.ListOptions{AfterID: "b", AfterType: "gauge"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repo.List(ctx, tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ids(got))
+		})
+	}
+
+	page, err := repo.List(ctx, storage.ListOptions{Type: "gauge", Prefix: "a"})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.NotNil(t, page[1].Value)
+	assert.Equal(t, 5.0, *page[1].Value)
+	assert.Nil(t, page[1].Delta)
+}
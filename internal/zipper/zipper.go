@@ -17,17 +17,25 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// wrappedResponseWriter buffers the response for compression. Event streams
+// must reach the client as they are written, so they go straight through.
 type wrappedResponseWriter struct {
 	http.ResponseWriter
 	body   bytes.Buffer
 	status int
 	wrote  bool
+	stream bool
 }
 
 func (w *wrappedResponseWriter) WriteHeader(code int) {
-	if !w.wrote {
-		w.status = code
-		w.wrote = true
+	if w.wrote {
+		return
+	}
+	w.status = code
+	w.wrote = true
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.stream = true
+		w.ResponseWriter.WriteHeader(code)
 	}
 }
 
@@ -35,9 +43,21 @@ func (w *wrappedResponseWriter) Write(b []byte) (int, error) {
 	if !w.wrote {
 		w.WriteHeader(http.StatusOK)
 	}
+	if w.stream {
+		return w.ResponseWriter.Write(b)
+	}
 	return w.body.Write(b)
 }
 
+// FlushError lets http.ResponseController flush streams; buffered responses
+// are sent when the handler returns.
+func (w *wrappedResponseWriter) FlushError() error {
+	if !w.stream {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
 func GzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
@@ -59,6 +79,9 @@ func GzipMiddleware(next http.Handler) http.Handler {
 
 		wrw := &wrappedResponseWriter{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(wrw, r)
+		if wrw.stream {
+			return
+		}
 
 		contentType := wrw.Header().Get("Content-Type")
 		if !(strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, "text/html")) {